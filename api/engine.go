@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	engine       = flag.String("engine", "http://host.docker.internal:4001", "Trading engine URL")
+	engineClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// checkOrder asks the engine whether it would accept the order, so an order
+// it would refuse, e.g. for lack of funds, is never queued. It returns the
+// reason the order is refused, or an empty string.
+func checkOrder(pair string, body []byte) (string, error) {
+	resp, err := engineClient.Post(fmt.Sprintf("%s/api/%s/check_order", *engine, pair), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Ok     bool   `json:"ok"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("check_order: %s", err)
+	}
+	if !result.Ok {
+		return result.Reason, nil
+	}
+	return "", nil
+}
+
+// lookupOrder asks the engine for the order an account placed in the pair
+// under a client order id. It returns nil when the engine does not know it.
+func lookupOrder(pair, accountId, clientOrderId string) (map[string]interface{}, error) {
+	resp, err := engineClient.Get(fmt.Sprintf("%s/api/orders/%s?account_id=%s", *engine,
+		url.PathEscape(clientOrderId), url.QueryEscape(accountId)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	result := struct {
+		Ok   bool                   `json:"ok"`
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("order: %s", err)
+	}
+	if !result.Ok || !strings.EqualFold(fmt.Sprint(result.Data["symbol"]), pair) {
+		return nil, nil
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var clientIdRetention = flag.Duration("client-id-retention", 24*time.Hour, "How long the answer to an order with a client_order_id is replayed to retries")
+
+// submission is the answer to an order sent with a client_order_id. Retries
+// of the same order wait for it instead of sending the order again. Only a
+// final answer is replayed: one telling the order is still on its way makes
+// the next retry look the order up.
+type submission struct {
+	done   chan struct{}
+	status int
+	body   interface{}
+	final  bool
+	at     time.Time
+}
+
+var submissions = struct {
+	sync.Mutex
+	m map[string]*submission
+}{m: make(map[string]*submission)}
+
+// claimSubmission returns the submission of a client order id, and whether
+// the caller is the first to send it and has to finish it. A first caller
+// told to look up has to find out whether an earlier attempt, last seen on
+// its way to the engine, got there before sending the order again.
+func claimSubmission(key string) (s *submission, first bool, lookup bool) {
+	submissions.Lock()
+	defer submissions.Unlock()
+
+	if s, ok := submissions.m[key]; ok && time.Since(s.at) < *clientIdRetention {
+		select {
+		case <-s.done:
+			lookup = !s.final
+		default:
+		}
+		if !lookup {
+			return s, false, false
+		}
+	}
+	s = &submission{done: make(chan struct{}), at: time.Now()}
+	submissions.m[key] = s
+	return s, true, lookup
+}
+
+// finishSubmission keeps the answer for retries. An order that never reached
+// the engine is forgotten, so a retry sends it again, and a 202 is kept only
+// to have the retry look the order up.
+func finishSubmission(key string, s *submission, status int, body interface{}, keep bool) {
+	submissions.Lock()
+	s.status, s.body = status, body
+	s.final = keep && status != http.StatusAccepted
+	if !keep {
+		delete(submissions.m, key)
+	}
+	submissions.Unlock()
+	close(s.done)
+}
+
+// pruneSubmissions drops answers once their retention is over.
+func pruneSubmissions() {
+	for range time.Tick(time.Minute) {
+		submissions.Lock()
+		for key, s := range submissions.m {
+			if time.Since(s.at) >= *clientIdRetention {
+				delete(submissions.m, key)
+			}
+		}
+		submissions.Unlock()
+	}
+}
@@ -16,18 +16,33 @@ func main() {
 	app := fiber.New()
 	app.Use(cors.New())
 	createOutputQueue()
+	go pruneSubmissions()
+	if err := startReplies(); err != nil {
+		log.Printf("orders will not be acknowledged: %s", err)
+	}
 
 	// POST /new_order
 	app.Post("/new_order", func(c *fiber.Ctx) error {
 		payload := struct {
-			Pairs      string `json:"pairs"`
-			OrderId    string `json:"order_id"`
-			OrderType  string `json:"order_type"`
-			PriceType  string `json:"price_type"`
-			Price      string `json:"price"`
-			Quantity   string `json:"quantity"`
-			Amount     string `json:"amount"`
-			CreateTime int64  `json:"create_time"`
+			Command       string `json:"command"`
+			Pairs         string `json:"pairs"`
+			OrderId       string `json:"order_id"`
+			OrderType     string `json:"order_type"`
+			PriceType     string `json:"price_type"`
+			Price         string `json:"price"`
+			Quantity      string `json:"quantity"`
+			Amount        string `json:"amount"`
+			StopPrice     string `json:"stop_price"`
+			DisplayQty    string `json:"display_quantity"`
+			TimeInForce   string `json:"time_in_force"`
+			ExpireTime    int64  `json:"expire_time"`
+			PostOnly      bool   `json:"post_only"`
+			PostOnlyMode  string `json:"post_only_mode"`
+			AccountId     string `json:"account_id"`
+			ClientOrderId string `json:"client_order_id"`
+			STPMode       string `json:"stp_mode"`
+			CreateTime    int64  `json:"create_time"`
+			Sequence      int64  `json:"sequence,omitempty"`
 		}{}
 
 		if err := c.BodyParser(&payload); err != nil {
@@ -38,6 +53,7 @@ func main() {
 		orderId := uuid.NewString()
 
 		// payload.OrderId = orderId
+		payload.Command = "new_order"
 		payload.CreateTime = ts
 
 		if strings.ToLower(payload.OrderType) == "ask" {
@@ -46,15 +62,134 @@ func main() {
 			payload.OrderId = fmt.Sprintf("b-%s", orderId)
 		}
 
+		// Orders are paid for from the balance of an account
+		if payload.AccountId == "" {
+			return c.Status(400).JSON(fiber.Map{"ok": false, "reason": "missing_account"})
+		}
+		if len(payload.ClientOrderId) > 64 {
+			return c.Status(400).JSON(fiber.Map{"ok": false, "reason": "invalid_client_order_id"})
+		}
+
+		// A retry of an order with a client_order_id gets the answer to the
+		// first attempt instead of sending the order again
+		var claimed *submission
+		var lookup bool
+		clientKey := fmt.Sprintf("%s/%s/%s", payload.Pairs, payload.AccountId, payload.ClientOrderId)
+		for payload.ClientOrderId != "" {
+			s, first, pending := claimSubmission(clientKey)
+			if first {
+				claimed, lookup = s, pending
+				break
+			}
+			<-s.done
+			if s.final {
+				return c.Status(s.status).JSON(s.body)
+			}
+		}
+
+		// respond answers the request, and keeps the answer for retries when
+		// the order reached the engine
+		respond := func(status int, body interface{}, keep bool) error {
+			if claimed != nil {
+				finishSubmission(clientKey, claimed, status, body, keep)
+			}
+			return c.Status(status).JSON(body)
+		}
+
+		// An earlier attempt that timed out may have been placed since
+		if lookup {
+			state, err := lookupOrder(payload.Pairs, payload.AccountId, payload.ClientOrderId)
+			if err != nil {
+				log.Printf("%s", err)
+				return respond(503, fiber.Map{"ok": false, "reason": "engine_unavailable"}, false)
+			}
+			if state != nil {
+				return respond(200, state, true)
+			}
+		}
+
 		// Parse payload to json string
+		jsonPayload, err := json.Marshal(payload)
+		if err != nil {
+			return respond(500, fiber.Map{"ok": false, "reason": err.Error()}, false)
+		}
+
+		reason, err := checkOrder(payload.Pairs, jsonPayload)
+		if err != nil {
+			log.Printf("%s", err)
+			return respond(503, fiber.Map{"ok": false, "reason": "engine_unavailable"}, false)
+		}
+		if reason != "" {
+			return respond(400, fiber.Map{"ok": false, "reason": reason, "order_id": payload.OrderId}, false)
+		}
+
+		key := fmt.Sprintf("%s-key", payload.Pairs)
+		if orderReplies == nil {
+			publishToTradingEngine(string(jsonPayload), key)
+			return respond(202, payload, true)
+		}
+
+		// Wait for the engine to sequence the order. Without an answer in
+		// time the order may still be queued, so its status is left to
+		// GET /api/orders/{order_id} on the engine
+		reply, err := orderReplies.request(jsonPayload, key)
+		if err == errReplyTimeout {
+			return respond(202, payload, true)
+		}
+		if err != nil {
+			log.Printf("%s", err)
+			return respond(503, fiber.Map{"ok": false, "reason": "engine_unavailable"}, false)
+		}
+		if !reply.Ok {
+			return respond(400, fiber.Map{"ok": false, "reason": reply.Reason, "order_id": payload.OrderId, "sequence": reply.Sequence}, true)
+		}
+
+		payload.Sequence = reply.Sequence
+		return respond(200, payload, true)
+	})
+
+	// POST /cancel_order goes through the same queue as new orders, so a
+	// cancel is never applied ahead of the order it names
+	app.Post("/cancel_order", func(c *fiber.Ctx) error {
+		payload := struct {
+			Command       string `json:"command"`
+			Pairs         string `json:"pairs"`
+			OrderId       string `json:"order_id"`
+			ClientOrderId string `json:"client_order_id"`
+			AccountId     string `json:"account_id"`
+		}{}
+
+		if err := c.BodyParser(&payload); err != nil {
+			return err
+		}
+		if payload.Pairs == "" || (payload.OrderId == "" && (payload.ClientOrderId == "" || payload.AccountId == "")) {
+			return c.Status(400).JSON(fiber.Map{"ok": false, "reason": "missing_order_id"})
+		}
+		payload.Command = "cancel_order"
+
 		jsonPayload, err := json.Marshal(payload)
 		if err != nil {
 			return c.SendString(err.Error())
 		}
 
-		publishToTradingEngine(string(jsonPayload), fmt.Sprintf("%s-key", payload.Pairs))
+		key := fmt.Sprintf("%s-key", payload.Pairs)
+		if orderReplies == nil {
+			publishToTradingEngine(string(jsonPayload), key)
+			return c.Status(202).JSON(payload)
+		}
 
-		return c.JSON(payload)
+		reply, err := orderReplies.request(jsonPayload, key)
+		if err == errReplyTimeout {
+			return c.Status(202).JSON(payload)
+		}
+		if err != nil {
+			log.Printf("%s", err)
+			return c.Status(503).JSON(fiber.Map{"ok": false, "reason": "engine_unavailable"})
+		}
+		if !reply.Ok {
+			return c.Status(400).JSON(fiber.Map{"ok": false, "reason": reply.Reason, "order_id": payload.OrderId, "sequence": reply.Sequence})
+		}
+		return c.JSON(fiber.Map{"ok": true, "order_id": payload.OrderId, "sequence": reply.Sequence})
 	})
 
 	log.Fatal(app.Listen(":3001"))
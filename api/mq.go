@@ -3,10 +3,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
@@ -137,3 +142,198 @@ func publishToTradingEngine(order string, key string) {
 		log.Fatalf("%s", err)
 	}
 }
+
+var replyTimeout = flag.Duration("reply-timeout", 5*time.Second, "How long an order waits for the engine to acknowledge it")
+
+// orderReply is the engine's answer to an order once it has been sequenced.
+type orderReply struct {
+	OrderId  string `json:"order_id"`
+	Ok       bool   `json:"ok"`
+	Reason   string `json:"reason"`
+	Sequence int64  `json:"sequence"`
+}
+
+var errReplyTimeout = errors.New("reply_timeout")
+
+// replies waits on one exclusive queue for the answers to every order sent,
+// matching them to their request by correlation id. When the connection
+// drops it is dialled again with a new queue; requests waiting on the old
+// one time out.
+type replies struct {
+	sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	queue   string
+	pending map[string]chan orderReply
+}
+
+var orderReplies *replies
+
+// how long to wait between attempts to reconnect the reply queue
+const redialDelay = time.Second
+
+// startReplies opens the connection orders are sent and answered on.
+func startReplies() error {
+	r := &replies{
+		pending: make(map[string]chan orderReply),
+	}
+	deliveries, closed, err := r.connect()
+	if err != nil {
+		return err
+	}
+	go r.dispatch(deliveries, closed)
+	orderReplies = r
+	return nil
+}
+
+// connect dials the broker and starts consuming a fresh reply queue. It
+// returns the answers and a channel told when the connection closes.
+func (r *replies) connect() (<-chan amqp.Delivery, chan *amqp.Error, error) {
+	connection, err := amqp.Dial(*uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Dial: %s", err)
+	}
+	closed := connection.NotifyClose(make(chan *amqp.Error, 1))
+
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return nil, nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	if err := channel.ExchangeDeclare(
+		*exchange,     // name
+		*exchangeType, // type
+		true,          // durable
+		false,         // auto-deleted
+		false,         // internal
+		false,         // noWait
+		nil,           // arguments
+	); err != nil {
+		connection.Close()
+		return nil, nil, fmt.Errorf("Exchange Declare: %s", err)
+	}
+
+	// A server-named queue that goes away with the connection
+	queue, err := channel.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // auto delete
+		true,  // exclusive
+		false, // no wait
+		nil,   // args
+	)
+	if err != nil {
+		connection.Close()
+		return nil, nil, fmt.Errorf("Queue Declare: %s", err)
+	}
+
+	deliveries, err := channel.Consume(
+		queue.Name, // name
+		"",         // consumerTag
+		true,       // autoAck
+		true,       // exclusive
+		false,      // noLocal
+		false,      // noWait
+		nil,        // arguments
+	)
+	if err != nil {
+		connection.Close()
+		return nil, nil, fmt.Errorf("Queue Consume: %s", err)
+	}
+
+	r.Lock()
+	r.conn, r.channel, r.queue = connection, channel, queue.Name
+	r.Unlock()
+	return deliveries, closed, nil
+}
+
+func (r *replies) dispatch(deliveries <-chan amqp.Delivery, closed chan *amqp.Error) {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				// The channel went away on its own, take the connection
+				// down with it so it is dialled again
+				deliveries = nil
+				r.conn.Close()
+				continue
+			}
+			r.answer(d)
+		case err := <-closed:
+			log.Printf("reply queue closed: %v", err)
+			deliveries, closed = r.redial()
+		}
+	}
+}
+
+// redial connects again, retrying until the broker is back.
+func (r *replies) redial() (<-chan amqp.Delivery, chan *amqp.Error) {
+	for {
+		deliveries, closed, err := r.connect()
+		if err == nil {
+			log.Printf("reply queue %s reconnected", r.queue)
+			return deliveries, closed
+		}
+		log.Printf("reply queue: %s", err)
+		time.Sleep(redialDelay)
+	}
+}
+
+func (r *replies) answer(d amqp.Delivery) {
+	var reply orderReply
+	if err := json.Unmarshal(d.Body, &reply); err != nil {
+		log.Printf("reply %s: %s", d.CorrelationId, err)
+		return
+	}
+
+	r.Lock()
+	ch, ok := r.pending[d.CorrelationId]
+	delete(r.pending, d.CorrelationId)
+	r.Unlock()
+
+	// Answers that come after their request gave up are dropped
+	if ok {
+		ch <- reply
+	}
+}
+
+// request sends an order to the engine and waits for its answer, or returns
+// errReplyTimeout once replyTimeout is over.
+func (r *replies) request(order []byte, key string) (orderReply, error) {
+	correlationId := uuid.NewString()
+	ch := make(chan orderReply, 1)
+
+	r.Lock()
+	r.pending[correlationId] = ch
+	channel, queue := r.channel, r.queue
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.pending, correlationId)
+		r.Unlock()
+	}()
+
+	if err := channel.Publish(
+		*exchange, // publish to an exchange
+		key,       // routing key
+		false,     // mandatory
+		false,     // immediate
+		amqp.Publishing{
+			ContentType:   "application/json",
+			CorrelationId: correlationId,
+			ReplyTo:       queue,
+			Body:          order,
+			DeliveryMode:  amqp.Transient,
+		},
+	); err != nil {
+		return orderReply{}, fmt.Errorf("Exchange Publish: %s", err)
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-time.After(*replyTimeout):
+		return orderReply{}, errReplyTimeout
+	}
+}
@@ -8,16 +8,15 @@ import useWebsocket from './useWebSocket.jsx';
 
 function App() {
 
-  const connectionMap = {
-    "btcusdt": 4001,
-    "ethusdt": 4002
-  }
+  // every pair is served by the same engine under /api/{symbol}
+  const engineHost = "localhost:4001";
   const [selectedPairs, setSelectedPairs] = createSignal("btcusdt");
 
   const [input, setInput] = createSignal({
     price_type: "limit",
     price: 0,
     quantity: 0,
+    account_id: "",
   });
 
 
@@ -28,7 +27,7 @@ function App() {
   const [historicalOrder, setHistoricalOrder] = createSignal([]);
 
   const [connect, disconnect, changeUrl, state, socket] = useWebsocket(
-    `ws://localhost:${connectionMap[selectedPairs()]}/ws`,
+    `ws://${engineHost}/api/${selectedPairs()}/ws`,
     (msg) => wsHandler(msg),
     (msg) => console.log(msg.error),
     [],
@@ -90,10 +89,15 @@ function App() {
         setOpenOrders([res.data, ...openOrders()]);
         console.log("order placed successfully");
       })
+      .catch((err) => {
+        // orders the engine would refuse are turned away with a reason
+        console.log(err.response ? err.response.data.reason : err.message);
+      })
   }
 
   async function cancelOrder(orderId) {
-    await axios.post(`http://localhost:${connectionMap[selectedPairs()]}/api/cancel_order`, { order_id: orderId })
+    // cancels are queued behind new orders, so they go through the api too
+    await axios.post("http://localhost:3001/cancel_order", { pairs: selectedPairs(), order_id: orderId })
       .then((res) => {
         // remove order from open orders
         if (res.status === 200) {
@@ -101,11 +105,14 @@ function App() {
           console.log("order cancelled successfully");
         }
       })
+      .catch((err) => {
+        console.log(err.response ? err.response.data.reason : err.message);
+      })
   }
 
   // get previous trading
   async function getHistoricalOrder() {
-    await axios.get(`http://localhost:${connectionMap[selectedPairs()]}/api/trade_log`)
+    await axios.get(`http://${engineHost}/api/${selectedPairs()}/trade_log`)
       .then((res) => {
         // remove order from open orders
         if (res.status === 200) {
@@ -133,7 +140,7 @@ function App() {
 
   const handleDropdownChange = (selectedValue) => {
     setSelectedPairs(selectedValue);
-    changeUrl(`ws://localhost:${connectionMap[selectedValue]}/ws`);
+    changeUrl(`ws://${engineHost}/api/${selectedValue}/ws`);
     refreshUI();
   };
 
@@ -257,7 +264,7 @@ function App() {
                   onChange={(event) => { handleInputChange("price_type", event.target.value) }}
                   class="block appearance-none w-full bg-white border border-gray-400 hover:border-gray-500 px-4 py-2 pr-8 rounded shadow leading-tight focus:outline-none focus:shadow-outline">
                   <option value="limit">Limted Order</option>
-                  <option value="market" disabled>Market Order</option>
+                  <option value="market">Market Order</option>
                 </select>
                 <div
                   class="pointer-events-none absolute inset-y-0 right-0 flex items-center px-2 text-gray-700">
@@ -267,6 +274,15 @@ function App() {
                 </div>
               </div>
             </div>
+            <div class="inline-block relative w-64 m-2">
+              <label class="block uppercase tracking-wide label-color text-xs font-bold mb-2"
+                for="grid-last-name">
+                Account
+              </label>
+              <input type="text" name="account_id" required
+                onChange={(event) => { handleInputChange("account_id", event.target.value) }}
+                class="w-full px-3 py-2 text-gray-700 border rounded focus:outline-none" placeholder="account id" />
+            </div>
             <div class="inline-block relative w-64 m-2">
               <label class="block uppercase tracking-wide label-color text-xs font-bold mb-2"
                 for="grid-last-name">
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	AssetBase  = "base"
+	AssetQuote = "quote"
+
+	RejectReasonNoAccount           = "missing_account"
+	RejectReasonInsufficientBalance = "insufficient_balance"
+	RejectReasonMaxSupply           = "above_max_supply"
+)
+
+var ErrInvalidAsset = errors.New("invalid_asset")
+
+var stopBuyMargin = flag.Int64("stop-buy-margin", 500, "basis points over its stop price a stop-market buy reserves for when the pair has no price band")
+
+// Balance holds the funds of an account in one pair: base in lots and quote
+// in ticks x lots. The held parts are reserved by open orders.
+type Balance struct {
+	Base      int64
+	BaseHold  int64
+	Quote     int64
+	QuoteHold int64
+}
+
+// BalanceRecord is a Balance in decimal units.
+type BalanceRecord struct {
+	Base      decimal.Decimal `json:"base"`
+	BaseHold  decimal.Decimal `json:"base_hold"`
+	Quote     decimal.Decimal `json:"quote"`
+	QuoteHold decimal.Decimal `json:"quote_hold"`
+}
+
+// hold is what an open order has reserved and not spent yet.
+type hold struct {
+	account string
+	asset   string
+	amount  int64
+}
+
+// HoldRecord is a hold in decimal units.
+type HoldRecord struct {
+	AccountId string          `json:"account_id"`
+	Asset     string          `json:"asset"`
+	Amount    decimal.Decimal `json:"amount"`
+}
+
+// TransferRecord is a deposit, or a withdrawal when negative, in the journal.
+type TransferRecord struct {
+	Asset  string          `json:"asset"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// Transfer queues a deposit to an account, or a withdrawal when amount is
+// negative. A withdrawal can only take funds that are not held.
+func (t *TradePair) Transfer(accountId, asset string, amount int64) CommandResult {
+	return t.submit(Command{
+		Type:      CommandTransfer,
+		AccountId: accountId,
+		Asset:     asset,
+		Amount:    amount,
+	})
+}
+
+// Balance returns the funds of an account, in decimal units.
+func (t *TradePair) Balance(accountId string) (BalanceRecord, bool) {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	b, ok := t.accounts[accountId]
+	if !ok {
+		return BalanceRecord{}, false
+	}
+	return t.balanceRecord(b), true
+}
+
+// ParseAsset reads an amount of base in lots or of quote in ticks x lots.
+func (t *TradePair) ParseAsset(asset, s string) (int64, error) {
+	switch asset {
+	case AssetBase:
+		return t.ParseQuantity(s)
+	case AssetQuote:
+		return t.ParseAmount(s)
+	}
+	return 0, ErrInvalidAsset
+}
+
+func (t *TradePair) assetToDecimal(asset string, v int64) decimal.Decimal {
+	if asset == AssetBase {
+		return t.LotsToQty(v)
+	}
+	return t.UnitsToAmount(v)
+}
+
+func (t *TradePair) assetUnits(asset string, d decimal.Decimal) int64 {
+	if asset == AssetBase {
+		return t.QtyLots(d)
+	}
+	return t.AmountUnits(d)
+}
+
+func (t *TradePair) balanceRecord(b *Balance) BalanceRecord {
+	return BalanceRecord{
+		Base:      t.LotsToQty(b.Base),
+		BaseHold:  t.LotsToQty(b.BaseHold),
+		Quote:     t.UnitsToAmount(b.Quote),
+		QuoteHold: t.UnitsToAmount(b.QuoteHold),
+	}
+}
+
+func (t *TradePair) account(accountId string) *Balance {
+	b, ok := t.accounts[accountId]
+	if !ok {
+		b = &Balance{}
+		t.accounts[accountId] = b
+	}
+	return b
+}
+
+func (t *TradePair) handlerTransfer(accountId, asset string, amount int64) string {
+	if accountId == "" {
+		return RejectReasonNoAccount
+	}
+	if asset != AssetBase && asset != AssetQuote {
+		return ErrInvalidAsset.Error()
+	}
+	// Trades only move funds around, so capping what all accounts hold
+	// together keeps every balance within an int64
+	if amount > math.MaxInt64-t.supply(asset) {
+		return RejectReasonMaxSupply
+	}
+
+	b := t.account(accountId)
+	funds, held := &b.Quote, b.QuoteHold
+	if asset == AssetBase {
+		funds, held = &b.Base, b.BaseHold
+	}
+	if *funds+amount < held {
+		return RejectReasonInsufficientBalance
+	}
+	*funds += amount
+	return ""
+}
+
+// supply is how much of the asset all accounts of the pair hold together.
+func (t *TradePair) supply(asset string) int64 {
+	var total int64
+	for _, b := range t.accounts {
+		if asset == AssetBase {
+			total += b.Base
+		} else {
+			total += b.Quote
+		}
+	}
+	return total
+}
+
+// required is what an order has to reserve: base for asks, quote for bids.
+// A stop-market bid reserves for its stop price plus the band margin and can
+// only buy that much once triggered. A market bid reserves all available
+// quote and gives back what its fills did not use.
+func (t *TradePair) required(item HeapItem) (string, int64) {
+	if item.GetOrderSide() == OrderSideSell {
+		return AssetBase, item.GetQuantity() + item.GetHiddenQuantity()
+	}
+
+	switch {
+	case byAmount(item):
+		return AssetQuote, item.GetAmount()
+	case item.GetPriceType() == PriceTypeLimit || item.GetPriceType() == PriceTypeStopLimit:
+		return AssetQuote, notional(item.GetPrice(), item.GetQuantity()+item.GetHiddenQuantity())
+	case item.GetPriceType() == PriceTypeStop:
+		return AssetQuote, notional(t.stopPrice(item), item.GetQuantity()+item.GetHiddenQuantity())
+	}
+	b := t.accounts[item.GetAccountId()]
+	if b == nil {
+		return AssetQuote, 0
+	}
+	return AssetQuote, b.Quote - b.QuoteHold
+}
+
+// stopPrice is the highest price a stop-market bid is expected to pay: its
+// stop price widened by the dynamic band it will meet once triggered, or the
+// static band, or the -stop-buy-margin when the pair has no bands.
+func (t *TradePair) stopPrice(item HeapItem) int64 {
+	margin := t.rules.dynamicBand
+	if margin <= 0 {
+		margin = t.rules.staticBand
+	}
+	if margin <= 0 {
+		margin = *stopBuyMargin
+	}
+	return addCapped(item.GetStopPrice(), notional(item.GetStopPrice(), margin)/10000)
+}
+
+// fundsReject is the reason the account cannot pay for the order, or an
+// empty string.
+func (t *TradePair) fundsReject(item HeapItem) string {
+	if item.GetAccountId() == "" {
+		return RejectReasonNoAccount
+	}
+
+	asset, amount := t.required(item)
+	b := t.accounts[item.GetAccountId()]
+	if b == nil || amount <= 0 {
+		return RejectReasonInsufficientBalance
+	}
+	available := b.Quote - b.QuoteHold
+	if asset == AssetBase {
+		available = b.Base - b.BaseHold
+	}
+	if amount > available {
+		return RejectReasonInsufficientBalance
+	}
+	return ""
+}
+
+// reserve holds the funds of a new order. It must pass fundsReject first.
+func (t *TradePair) reserve(item HeapItem) {
+	asset, amount := t.required(item)
+	t.addHold(item.GetUniqueId(), item.GetAccountId(), asset, amount)
+}
+
+func (t *TradePair) addHold(uniq, accountId, asset string, amount int64) {
+	b := t.account(accountId)
+	if asset == AssetBase {
+		b.BaseHold += amount
+	} else {
+		b.QuoteHold += amount
+	}
+
+	h, ok := t.holds[uniq]
+	if !ok {
+		h = &hold{account: accountId, asset: asset}
+		t.holds[uniq] = h
+	}
+	h.amount += amount
+	t.touched[uniq] = true
+}
+
+// rehold changes the reservation of an amended order to the funds it needs
+// at its new price and quantity.
+func (t *TradePair) rehold(item HeapItem, price, quantity int64) string {
+	amount := quantity
+	asset := AssetBase
+	if item.GetOrderSide() == OrderSideBuy {
+		amount, asset = notional(price, quantity), AssetQuote
+	}
+
+	var held int64
+	if h, ok := t.holds[item.GetUniqueId()]; ok {
+		held = h.amount
+	}
+	b := t.account(item.GetAccountId())
+	available := b.Quote - b.QuoteHold
+	if asset == AssetBase {
+		available = b.Base - b.BaseHold
+	}
+	if amount-held > available {
+		return RejectReasonInsufficientBalance
+	}
+	t.addHold(item.GetUniqueId(), item.GetAccountId(), asset, amount-held)
+	return ""
+}
+
+// heldFor is what is left of the reservation of an order.
+func (t *TradePair) heldFor(uniq string) int64 {
+	if h, ok := t.holds[uniq]; ok {
+		return h.amount
+	}
+	return 0
+}
+
+// affordable caps the quantity a bid taker can buy at price with what it has
+// reserved.
+func (t *TradePair) affordable(taker HeapItem, price, quantity int64) int64 {
+	if taker.GetOrderSide() != OrderSideBuy {
+		return quantity
+	}
+	return min64(quantity, t.heldFor(taker.GetUniqueId())/price)
+}
+
+// spend takes a fill out of the order's reservation and its account.
+func (t *TradePair) spend(uniq string, amount int64) {
+	t.touched[uniq] = true
+	h, ok := t.holds[uniq]
+	if !ok {
+		return
+	}
+	h.amount -= amount
+
+	b := t.account(h.account)
+	if h.asset == AssetBase {
+		b.BaseHold -= amount
+		b.Base -= amount
+	} else {
+		b.QuoteHold -= amount
+		b.Quote -= amount
+	}
+}
+
+// settleFunds moves the funds of a trade between the two accounts, less the
+// fees, which go to the fee account. The value of a trade is paid out of the
+// bid's reservation, and funds only move between accounts whose total
+// handlerTransfer keeps within an int64, so none of this can overflow.
+func (t *TradePair) settleFunds(ask, bid HeapItem, price, quantity, askFee, bidFee int64) {
+	t.spend(ask.GetUniqueId(), quantity)
+	t.spend(bid.GetUniqueId(), price*quantity)
+	t.account(ask.GetAccountId()).Quote += price*quantity - askFee
+	t.account(bid.GetAccountId()).Base += quantity - bidFee
+
+	if askFee > 0 || bidFee > 0 {
+		collector := t.account(t.rules.feeAccount)
+		collector.Quote += askFee
+		collector.Base += bidFee
+	}
+}
+
+// releaseHolds gives back what is left of the reservations of the orders the
+// last command closed. Orders still open keep what their remainder needs, so
+// a bid filled below its price releases the difference.
+func (t *TradePair) releaseHolds() {
+	for uniq := range t.touched {
+		delete(t.touched, uniq)
+
+		h, ok := t.holds[uniq]
+		if !ok {
+			continue
+		}
+		release := h.amount
+		if item := t.openOrder(uniq); item != nil {
+			_, need := t.required(item)
+			release = h.amount - need
+			if release <= 0 {
+				continue
+			}
+		}
+
+		h.amount -= release
+		b := t.account(h.account)
+		if h.asset == AssetBase {
+			b.BaseHold -= release
+		} else {
+			b.QuoteHold -= release
+		}
+		if h.amount == 0 {
+			delete(t.holds, uniq)
+		}
+	}
+}
+
+func (t *TradePair) openOrder(uniq string) HeapItem {
+	if item := t.AsksOrderbook.Find(uniq); item != nil {
+		return item
+	}
+	if item := t.BidsOrderbook.Find(uniq); item != nil {
+		return item
+	}
+	return t.StopBook.Find(uniq)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+var adminToken = flag.String("admin-token", "", "bearer token the admin endpoints require (empty requires none)")
+
+// startAdmin serves the endpoints that create pairs, change their status and
+// move funds on a listener of their own, away from the public api.
+func startAdmin(port string) {
+	admin := gin.New()
+	admin.Use(adminAuth())
+
+	admin.GET("/admin/pairs", adminListPairs)
+	admin.POST("/admin/pairs", adminCreatePair)
+	admin.POST("/admin/pairs/:symbol/status", adminSetPairStatus)
+	admin.POST("/admin/pairs/:symbol/auction", adminStartAuction)
+	admin.GET("/admin/pairs/:symbol/accounts/:account", adminBalance)
+	admin.POST("/admin/pairs/:symbol/accounts/:account/deposit", adminDeposit)
+	admin.POST("/admin/pairs/:symbol/accounts/:account/withdraw", adminWithdraw)
+	admin.POST("/admin/pairs/:symbol/accounts/:account/tier", adminSetAccountTier)
+	admin.POST("/admin/pairs/:symbol/accounts/:account/stp", adminSetAccountSTP)
+
+	log.Println(admin.Run(":" + port))
+}
+
+// adminAuth turns away requests without the -admin-token, when one is set.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if *adminToken == "" {
+			c.Next()
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			c.AbortWithStatusJSON(401, gin.H{"ok": false, "reason": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func pairInfo(pair *TradePair) gin.H {
+	cfg := registry.Config(pair.Symbol)
+	return gin.H{
+		"symbol":         pair.Symbol,
+		"status":         PairStatus2String(pair.Status()),
+		"price_digit":    cfg.PriceDigit,
+		"quantity_digit": cfg.QuantityDigit,
+		"tick_size":      cfg.Rules.TickSize.String(),
+		"lot_size":       cfg.Rules.LotSize.String(),
+		"min_quantity":   cfg.Rules.MinQuantity.String(),
+		"max_quantity":   cfg.Rules.MaxQuantity.String(),
+		"min_notional":   cfg.Rules.MinNotional.String(),
+		"static_band":    cfg.Rules.StaticBand.String(),
+		"dynamic_band":   cfg.Rules.DynamicBand.String(),
+		"band_action":    cfg.Rules.BandAction,
+		"band_duration":  cfg.Rules.BandDuration,
+		"fees":           cfg.Rules.Fees,
+		"fee_account":    cfg.Rules.FeeAccount,
+	}
+}
+
+func adminListPairs(c *gin.Context) {
+	list := []gin.H{}
+	for _, pair := range registry.All() {
+		list = append(list, pairInfo(pair))
+	}
+
+	c.JSON(200, gin.H{
+		"ok": true,
+		"data": gin.H{
+			"pairs": list,
+		},
+	})
+}
+
+// adminCreatePair opens a new pair and starts consuming its orders. It starts
+// in pre-open unless another status is asked for.
+func adminCreatePair(c *gin.Context) {
+	type args struct {
+		Symbol        string             `json:"symbol"`
+		PriceDigit    int                `json:"price_digit"`
+		QuantityDigit int                `json:"quantity_digit"`
+		TickSize      string             `json:"tick_size"`
+		LotSize       string             `json:"lot_size"`
+		MinQuantity   string             `json:"min_quantity"`
+		MaxQuantity   string             `json:"max_quantity"`
+		MinNotional   string             `json:"min_notional"`
+		StaticBand    string             `json:"static_band"`
+		DynamicBand   string             `json:"dynamic_band"`
+		BandAction    string             `json:"band_action"`
+		BandDuration  string             `json:"band_duration"`
+		Fees          map[string]FeeRate `json:"fees"`
+		FeeAccount    string             `json:"fee_account"`
+		Status        string             `json:"status"`
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	if !validSymbol(param.Symbol) || param.PriceDigit < 0 || param.QuantityDigit < 0 {
+		c.JSON(400, gin.H{"ok": false, "reason": "invalid_pair"})
+		return
+	}
+
+	status := PairStatusPreOpen
+	if param.Status != "" {
+		var ok bool
+		if status, ok = string2PairStatus(param.Status); !ok {
+			c.JSON(400, gin.H{"ok": false, "reason": "invalid_status"})
+			return
+		}
+	}
+
+	cfg := PairConfig{
+		Symbol:        param.Symbol,
+		PriceDigit:    param.PriceDigit,
+		QuantityDigit: param.QuantityDigit,
+	}
+	cfg.Rules.BandAction = param.BandAction
+	cfg.Rules.BandDuration = param.BandDuration
+	cfg.Rules.Fees = param.Fees
+	cfg.Rules.FeeAccount = param.FeeAccount
+	for _, f := range []struct {
+		value string
+		dst   *decimal.Decimal
+	}{
+		{param.TickSize, &cfg.Rules.TickSize},
+		{param.LotSize, &cfg.Rules.LotSize},
+		{param.MinQuantity, &cfg.Rules.MinQuantity},
+		{param.MaxQuantity, &cfg.Rules.MaxQuantity},
+		{param.MinNotional, &cfg.Rules.MinNotional},
+		{param.StaticBand, &cfg.Rules.StaticBand},
+		{param.DynamicBand, &cfg.Rules.DynamicBand},
+	} {
+		d, err := string2decimal(f.value)
+		if err != nil {
+			c.JSON(400, gin.H{"ok": false, "reason": RejectReasonInvalidNumber})
+			return
+		}
+		*f.dst = d
+	}
+
+	pair, err := registry.Create(cfg)
+	if pair == nil {
+		c.JSON(400, gin.H{"ok": false, "reason": err.Error()})
+		return
+	}
+	// The pair is up even when it could not be recorded for the next start
+	if err != nil {
+		logrus.Errorf("%s", err)
+	}
+
+	servePair(pair)
+	if status != PairStatusOpen {
+		pair.SetStatus(status)
+	}
+	if err := MQBind(pair); err != nil {
+		c.JSON(500, gin.H{"ok": false, "reason": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"ok":   true,
+		"data": pairInfo(pair),
+	})
+}
+
+func adminSetPairStatus(c *gin.Context) {
+	type args struct {
+		Status string `json:"status"`
+	}
+
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	status, ok := string2PairStatus(param.Status)
+	if !ok {
+		c.JSON(400, gin.H{"ok": false, "reason": "invalid_status"})
+		return
+	}
+
+	result := pair.SetStatus(status)
+
+	c.JSON(200, gin.H{
+		"ok":       result.Ok,
+		"reason":   result.Reason,
+		"sequence": result.Sequence,
+	})
+}
+
+// adminStartAuction puts the pair into a call auction. Without a duration it
+// lasts until the pair is set open again.
+func adminStartAuction(c *gin.Context) {
+	type args struct {
+		Duration string `json:"duration"`
+	}
+
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	var duration time.Duration
+	if param.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(param.Duration)
+		if err != nil || duration < 0 {
+			c.JSON(400, gin.H{"ok": false, "reason": "invalid_duration"})
+			return
+		}
+	}
+
+	result := pair.StartAuction(duration)
+
+	c.JSON(200, gin.H{
+		"ok":       result.Ok,
+		"reason":   result.Reason,
+		"sequence": result.Sequence,
+	})
+}
+
+// adminBalance shows the balances of an account and what its open orders hold.
+func adminBalance(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	b, ok := pair.Balance(c.Param("account"))
+	if !ok {
+		c.JSON(404, gin.H{"ok": false, "reason": "unknown_account"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"ok": true,
+		"data": gin.H{
+			"base":       pair.Qty2String(b.Base),
+			"base_hold":  pair.Qty2String(b.BaseHold),
+			"quote":      pair.Amount2String(b.Quote),
+			"quote_hold": pair.Amount2String(b.QuoteHold),
+		},
+	})
+}
+
+func adminDeposit(c *gin.Context) {
+	adminTransfer(c, 1)
+}
+
+func adminWithdraw(c *gin.Context) {
+	adminTransfer(c, -1)
+}
+
+// adminTransfer moves funds of one asset in or out of an account.
+func adminTransfer(c *gin.Context, sign int64) {
+	type args struct {
+		Asset  string `json:"asset"`
+		Amount string `json:"amount"`
+	}
+
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	amount, err := pair.ParseAsset(param.Asset, param.Amount)
+	if err != nil || amount <= 0 {
+		reason := RejectReasonInvalidNumber
+		if err == ErrInvalidAsset {
+			reason = err.Error()
+		}
+		c.JSON(400, gin.H{"ok": false, "reason": reason})
+		return
+	}
+
+	result := pair.Transfer(c.Param("account"), param.Asset, sign*amount)
+	if !result.Ok {
+		c.JSON(200, gin.H{"ok": false, "reason": result.Reason, "sequence": result.Sequence})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"ok":       true,
+		"sequence": result.Sequence,
+	})
+}
+
+// adminSetAccountTier moves an account to another fee tier of the pair.
+func adminSetAccountTier(c *gin.Context) {
+	type args struct {
+		Tier string `json:"tier"`
+	}
+
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	result := pair.SetAccountTier(c.Param("account"), param.Tier)
+	if !result.Ok {
+		c.JSON(400, gin.H{"ok": false, "reason": result.Reason, "sequence": result.Sequence})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"ok":       true,
+		"sequence": result.Sequence,
+	})
+}
+
+// adminSetAccountSTP sets the self-trade prevention mode used by the orders
+// of an account that do not carry their own.
+func adminSetAccountSTP(c *gin.Context) {
+	type args struct {
+		STPMode string `json:"stp_mode"`
+	}
+
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	result := pair.SetAccountSTPMode(c.Param("account"), string2STPMode(param.STPMode))
+
+	c.JSON(200, gin.H{
+		"ok":       result.Ok,
+		"reason":   result.Reason,
+		"sequence": result.Sequence,
+	})
+}
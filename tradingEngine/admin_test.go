@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+	defer func(token string) { *adminToken = token }(*adminToken)
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		token  string
+		header string
+		want   int
+	}{
+		{"", "", 200},
+		{"secret", "", 401},
+		{"secret", "Bearer wrong", 401},
+		{"secret", "Bearer secret", 200},
+	}
+	for _, tt := range tests {
+		*adminToken = tt.token
+		admin := gin.New()
+		admin.Use(adminAuth())
+		admin.GET("/admin/pairs", func(c *gin.Context) { c.Status(200) })
+
+		req := httptest.NewRequest("GET", "/admin/pairs", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("token %q, header %q: got %d, want %d", tt.token, tt.header, w.Code, tt.want)
+		}
+	}
+}
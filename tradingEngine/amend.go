@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+const (
+	AmendRejectNotOpen  = "order_not_open"
+	AmendRejectInvalid  = "invalid_amendment"
+	AmendRejectPostOnly = "post_only_would_take"
+)
+
+// AmendRequest changes the price and/or the open quantity of a resting order.
+// A zero price or quantity leaves that side of the order untouched. With an
+// account only an order of that account is changed.
+type AmendRequest struct {
+	OrderId   string          `json:"order_id"`
+	AccountId string          `json:"account_id,omitempty"`
+	Price     decimal.Decimal `json:"price"`
+	Quantity  decimal.Decimal `json:"quantity"`
+}
+
+type AmendResult struct {
+	Symbol   string          `json:"symbol"`
+	OrderId  string          `json:"order_id"`
+	Accepted bool            `json:"accepted"`
+	Reason   string          `json:"reason"`
+	Price    decimal.Decimal `json:"price"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Sequence int64           `json:"sequence"`
+}
+
+// AmendOrder queues a cancel-replace of an order of the account and waits
+// until it has been applied.
+func (t *TradePair) AmendOrder(uniq, accountId string, price, quantity decimal.Decimal) CommandResult {
+	return t.submit(Command{
+		Type: CommandAmendOrder,
+		Amend: &AmendRequest{
+			OrderId:   uniq,
+			AccountId: accountId,
+			Price:     price,
+			Quantity:  quantity,
+		},
+	})
+}
+
+// handlerAmendOrder replaces a resting order in place. Reducing the quantity
+// keeps its time priority; a new price or a larger quantity sends it to the
+// back of its price level, and a new price that crosses the book trades first.
+func (t *TradePair) handlerAmendOrder(req *AmendRequest) string {
+	book := t.BidsOrderbook
+	item := t.BidsOrderbook.Find(req.OrderId)
+	if item == nil {
+		book = t.AsksOrderbook
+		item = t.AsksOrderbook.Find(req.OrderId)
+	}
+	// The order of another account is as good as unknown
+	if item == nil || (req.AccountId != "" && item.GetAccountId() != req.AccountId) {
+		t.sendAmendNotify(req, false, AmendRejectNotOpen)
+		return AmendRejectNotOpen
+	}
+	if req.Price.Sign() < 0 || req.Quantity.Sign() < 0 {
+		t.sendAmendNotify(req, false, AmendRejectInvalid)
+		return AmendRejectInvalid
+	}
+	if reason := t.statusReject(); reason != "" {
+		t.sendAmendNotify(req, false, reason)
+		return reason
+	}
+
+	open := item.GetQuantity() + item.GetHiddenQuantity()
+	quantity := open
+	if req.Quantity.Sign() > 0 {
+		lots, err := scaleDecimal(req.Quantity, t.quantityDigit, ErrLotSize)
+		if err != nil {
+			t.sendAmendNotify(req, false, err.Error())
+			return err.Error()
+		}
+		quantity = lots
+	}
+	price := item.GetPrice()
+	if req.Price.Sign() > 0 {
+		ticks, err := scaleDecimal(req.Price, t.priceDigit, ErrTickSize)
+		if err != nil {
+			t.sendAmendNotify(req, false, err.Error())
+			return err.Error()
+		}
+		price = ticks
+	}
+
+	// The replacement has to meet the same trading rules as a new order
+	if price%t.rules.tick != 0 {
+		t.sendAmendNotify(req, false, RejectReasonTickSize)
+		return RejectReasonTickSize
+	}
+	if reason := t.checkQuantity(price, quantity, item.GetDisplayQuantity()); reason != "" {
+		t.sendAmendNotify(req, false, reason)
+		return reason
+	}
+
+	if reason := t.rehold(item, price, quantity); reason != "" {
+		t.sendAmendNotify(req, false, reason)
+		return reason
+	}
+
+	opposite := t.oppositeBook(item)
+	crossing := opposite.Len() > 0 && price != item.GetPrice() && crossesAt(item.GetOrderSide(), price, opposite.Root().GetPrice())
+	if crossing && item.IsPostOnly() {
+		t.sendAmendNotify(req, false, AmendRejectPostOnly)
+		return AmendRejectPostOnly
+	}
+
+	// Smaller size at the same price keeps its place in the queue
+	if price == item.GetPrice() && quantity <= open {
+		visible := min64(item.GetQuantity(), quantity)
+		item.SetQuantity(visible)
+		item.SetHiddenQuantity(quantity - visible)
+		book.Update(item)
+		t.sendAmendNotify(req, true, "")
+		return ""
+	}
+
+	item.SetPrice(price)
+	item.SetQuantity(quantity)
+	item.SetHiddenQuantity(0)
+	t.sendAmendNotify(req, true, "")
+
+	// Without matching the replacement rests even when it crosses
+	if !crossing || t.status != PairStatusOpen {
+		item.Hide()
+		book.Requeue(item)
+		return ""
+	}
+
+	// The replacement takes liquidity like a new order before resting again
+	book.Remove(item.GetUniqueId())
+	if ok, _ := t.matchTaker(item); ok && t.unfilled(item) {
+		t.pushOrder(item)
+	}
+	t.triggerStops()
+	return ""
+}
+
+func crossesAt(side OrderSide, price, opposite int64) bool {
+	if side == OrderSideBuy {
+		return price >= opposite
+	}
+	return price <= opposite
+}
+
+func (t *TradePair) sendAmendNotify(req *AmendRequest, accepted bool, reason string) {
+	if accepted {
+		t.orderReplaced(req.OrderId, true)
+	}
+	if t.replaying {
+		return
+	}
+
+	result := AmendResult{
+		Symbol:   t.Symbol,
+		OrderId:  req.OrderId,
+		Accepted: accepted,
+		Reason:   reason,
+		Price:    req.Price,
+		Quantity: req.Quantity,
+		Sequence: t.sequence,
+	}
+	t.output(JournalRecord{Kind: RecordAmend, Sequence: t.sequence, AmendResult: &result})
+}
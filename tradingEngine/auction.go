@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const RejectReasonAuctionNotDue = "auction_not_due"
+
+// AuctionInfo is the price and volume the book would uncross at if the
+// auction ended now.
+type AuctionInfo struct {
+	Symbol    string          `json:"symbol"`
+	Status    string          `json:"status"`
+	Price     decimal.Decimal `json:"price"`
+	Volume    decimal.Decimal `json:"volume"`
+	Imbalance decimal.Decimal `json:"imbalance"`
+	EndTime   int64           `json:"end_time"`
+}
+
+// StartAuction moves the pair into a call auction. With a duration the
+// auction uncrosses and reopens by itself once it is over.
+func (t *TradePair) StartAuction(duration time.Duration) CommandResult {
+	return t.submit(Command{
+		Type:     CommandSetStatus,
+		Status:   PairStatusAuction,
+		Duration: int64(duration),
+	})
+}
+
+// Indicative reports the current uncross of a pair that is not matching.
+func (t *TradePair) Indicative() (AuctionInfo, bool) {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	if !t.collecting() {
+		return AuctionInfo{}, false
+	}
+	price, volume, imbalance := t.equilibrium()
+	return AuctionInfo{
+		Symbol:    t.Symbol,
+		Status:    PairStatus2String(t.status),
+		Price:     t.TicksToPrice(price),
+		Volume:    t.LotsToQty(volume),
+		Imbalance: t.LotsToQty(imbalance),
+		EndTime:   t.auctionEnd,
+	}, true
+}
+
+// collecting reports whether orders rest without matching, to be uncrossed
+// when the pair opens.
+func (t *TradePair) collecting() bool {
+	return t.status == PairStatusPreOpen || t.status == PairStatusHalted || t.status == PairStatusAuction
+}
+
+// equilibrium picks the uncross price: the one executing the most volume,
+// then leaving the smallest imbalance, then closest to the reference price,
+// or to the last trade price before there is one. The lower price wins a
+// remaining tie. The volume is zero when the book does not cross.
+func (t *TradePair) equilibrium() (price, volume, imbalance int64) {
+	bids, asks := map[int64]int64{}, map[int64]int64{}
+	prices := []int64{}
+	for _, side := range []struct {
+		book *Orderbook
+		qty  map[int64]int64
+	}{{t.BidsOrderbook, bids}, {t.AsksOrderbook, asks}} {
+		side.book.Walk(func(item HeapItem) bool {
+			if _, ok := bids[item.GetPrice()]; !ok {
+				if _, ok := asks[item.GetPrice()]; !ok {
+					prices = append(prices, item.GetPrice())
+				}
+			}
+			side.qty[item.GetPrice()] += item.GetQuantity() + item.GetHiddenQuantity()
+			return true
+		})
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+
+	// Bids at or above a price and asks at or below it can trade there
+	bidVol := make([]int64, len(prices))
+	askVol := make([]int64, len(prices))
+	for i := len(prices) - 1; i >= 0; i-- {
+		bidVol[i] = bids[prices[i]]
+		if i+1 < len(prices) {
+			bidVol[i] += bidVol[i+1]
+		}
+	}
+	for i := range prices {
+		askVol[i] = asks[prices[i]]
+		if i > 0 {
+			askVol[i] += askVol[i-1]
+		}
+	}
+
+	reference := t.referencePrice
+	if reference == 0 {
+		reference = t.latestPrice
+	}
+	distance := func(p int64) int64 {
+		if p > reference {
+			return p - reference
+		}
+		return reference - p
+	}
+	for i, p := range prices {
+		exec := min64(bidVol[i], askVol[i])
+		if exec <= 0 {
+			continue
+		}
+		imb := bidVol[i] - askVol[i]
+		if imb < 0 {
+			imb = -imb
+		}
+		better := exec > volume ||
+			(exec == volume && imb < imbalance) ||
+			(exec == volume && imb == imbalance && reference > 0 && distance(p) < distance(price))
+		if better {
+			price, volume, imbalance = p, exec, imb
+		}
+	}
+	return price, volume, imbalance
+}
+
+// uncross ends the auction: everything that can trade at the equilibrium
+// price does so at that single price, in the priority of each book.
+func (t *TradePair) uncross() {
+	price, volume, _ := t.equilibrium()
+	if volume <= 0 {
+		return
+	}
+	// The bands are centred on the price the auction found
+	t.referencePrice = price
+
+	for t.AsksOrderbook.Len() > 0 && t.BidsOrderbook.Len() > 0 {
+		ask, bid := t.AsksOrderbook.Root(), t.BidsOrderbook.Root()
+		if bid.GetPrice() < price || ask.GetPrice() > price {
+			return
+		}
+
+		if isSelfTrade(bid, ask) && t.stpMode(t.auctionTaker(ask, bid)) != STPNone {
+			taker, maker, takerBook, makerBook := bid, ask, t.BidsOrderbook, t.AsksOrderbook
+			if t.auctionTaker(ask, bid) == ask {
+				taker, maker, takerBook, makerBook = ask, bid, t.AsksOrderbook, t.BidsOrderbook
+			}
+			if t.preventSelfTrade(t.stpMode(taker), makerBook, taker, maker) {
+				takerBook.Remove(taker.GetUniqueId())
+				delete(t.expiries, taker.GetUniqueId())
+			} else {
+				t.settleOrder(takerBook, taker)
+			}
+			continue
+		}
+
+		qty := min64(ask.GetQuantity(), bid.GetQuantity())
+		ask.SetQuantity(ask.GetQuantity() - qty)
+		bid.SetQuantity(bid.GetQuantity() - qty)
+		t.sendTradeResultNotify(ask, bid, price, qty, t.auctionTaker(ask, bid).GetOrderSide())
+		t.settleOrder(t.AsksOrderbook, ask)
+		t.settleOrder(t.BidsOrderbook, bid)
+	}
+}
+
+// auctionTaker is the later of two orders meeting in the uncross, which is
+// the one self-trade prevention applies to and the one paying the taker fee.
+func (t *TradePair) auctionTaker(ask, bid HeapItem) HeapItem {
+	if ask.GetCreateTime() > bid.GetCreateTime() || (ask.GetCreateTime() == bid.GetCreateTime() && ask.GetUniqueId() > bid.GetUniqueId()) {
+		return ask
+	}
+	return bid
+}
+
+// handlerEndAuction reopens the pair once a timed auction or halt is over.
+func (t *TradePair) handlerEndAuction() string {
+	if !t.timed() || t.timestamp < t.auctionEnd {
+		return RejectReasonAuctionNotDue
+	}
+	return t.handlerSetStatus(PairStatusOpen, 0)
+}
+
+func (t *TradePair) auctionDue(now int64) bool {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	return t.timed() && now >= t.auctionEnd
+}
+
+func (t *TradePair) timed() bool {
+	return (t.status == PairStatusAuction || t.status == PairStatusHalted) && t.auctionEnd > 0
+}
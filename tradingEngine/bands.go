@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BandActionReject  = "reject"
+	BandActionHalt    = "halt"
+	BandActionAuction = "auction"
+
+	CancelReasonPriceBand = "price_band"
+	RejectReasonPriceBand = "price_band"
+)
+
+// bands are held in basis points of the price they are centred on
+const bandDigit = 4
+
+// BandResult reports a trade that was stopped for printing outside the price
+// bands, and what the pair did about it.
+type BandResult struct {
+	Symbol    string          `json:"symbol"`
+	OrderId   string          `json:"order_id"`
+	Price     decimal.Decimal `json:"price"`
+	Low       decimal.Decimal `json:"low"`
+	High      decimal.Decimal `json:"high"`
+	Reference decimal.Decimal `json:"reference"`
+	Action    string          `json:"action"`
+	Sequence  int64           `json:"sequence"`
+}
+
+// setBands scales the band settings of the rules.
+func (r *tradingRules) setBands(rules TradingRules) error {
+	var err error
+	if r.staticBand, err = scaleDecimal(rules.StaticBand, bandDigit, ErrInvalidNumber); err != nil {
+		return err
+	}
+	if r.dynamicBand, err = scaleDecimal(rules.DynamicBand, bandDigit, ErrInvalidNumber); err != nil {
+		return err
+	}
+
+	switch rules.BandAction {
+	case "":
+		r.bandAction = BandActionReject
+	case BandActionReject, BandActionHalt, BandActionAuction:
+		r.bandAction = rules.BandAction
+	default:
+		return ErrBandAction
+	}
+
+	if rules.BandDuration != "" {
+		d, err := time.ParseDuration(rules.BandDuration)
+		if err != nil || d < 0 {
+			return ErrBandDuration
+		}
+		r.bandDuration = int64(d)
+	}
+	return nil
+}
+
+// bandLimits is the range trades may print in: the static band around the
+// reference price, narrowed by the dynamic band around last, the price the
+// taker found when it arrived. A zero bound is not limited.
+func (t *TradePair) bandLimits(last int64) (low, high int64) {
+	narrow := func(centre, band int64) {
+		if centre <= 0 || band <= 0 {
+			return
+		}
+		// A band too wide to work out limits nothing
+		width, ok := mulInt64(centre, band)
+		if !ok {
+			return
+		}
+		width /= 10000
+		if l := centre - width; l > low {
+			low = l
+		}
+		if width <= math.MaxInt64-centre {
+			if h := centre + width; high == 0 || h < high {
+				high = h
+			}
+		}
+	}
+	narrow(t.referencePrice, t.rules.staticBand)
+	narrow(last, t.rules.dynamicBand)
+	return low, high
+}
+
+func inBand(price, low, high int64) bool {
+	return price >= low && (high == 0 || price <= high)
+}
+
+// bandBreach stops a taker about to trade outside the bands. Depending on the
+// rules it is refused, or the pair stops matching for a while and the taker
+// is handled like an order arriving in that status. A new order that has not
+// traded yet is rejected; anything else loses its remainder. It returns the
+// reason the taker was refused, or an empty string.
+func (t *TradePair) bandBreach(taker HeapItem, price, low, high int64, filled bool) string {
+	t.sendBandNotify(taker.GetUniqueId(), price, low, high)
+
+	switch t.rules.bandAction {
+	case BandActionHalt:
+		t.handlerSetStatus(PairStatusHalted, t.rules.bandDuration)
+		return t.restOrder(taker)
+	case BandActionAuction:
+		t.handlerSetStatus(PairStatusAuction, t.rules.bandDuration)
+		return t.restOrder(taker)
+	}
+	if !filled && taker.GetUniqueId() == t.incoming {
+		t.sendRejectNotify(taker.GetUniqueId(), RejectReasonPriceBand)
+		return RejectReasonPriceBand
+	}
+	t.sendCancelNotify(taker.GetUniqueId(), CancelReasonPriceBand)
+	return ""
+}
+
+func (t *TradePair) sendBandNotify(uniq string, price, low, high int64) {
+	if t.replaying {
+		return
+	}
+
+	result := BandResult{
+		Symbol:    t.Symbol,
+		OrderId:   uniq,
+		Price:     t.TicksToPrice(price),
+		Low:       t.TicksToPrice(low),
+		High:      t.TicksToPrice(high),
+		Reference: t.TicksToPrice(t.referencePrice),
+		Action:    t.rules.bandAction,
+		Sequence:  t.sequence,
+	}
+
+	logrus.Warnf("%s price band breached by %s at %s, allowed %s - %s", t.Symbol, uniq, result.Price, result.Low, result.High)
+	t.output(JournalRecord{Kind: RecordBand, Sequence: t.sequence, Band: &result})
+}
@@ -1,61 +1,37 @@
 package main
 
-import (
-	"container/heap"
-	"github.com/shopspring/decimal"
-)
-
 type HeapItem interface {
-	SetIndex(index int)
-	SetQuantity(quantity decimal.Decimal)
-	SetAmount(amount decimal.Decimal)
+	SetSequence(sequence int64)
+	SetQuantity(quantity int64)
+	SetAmount(amount int64)
+	SetPrice(price int64)
+	SetPriceType(pt PriceType)
+	SetStopPrice(stopPrice int64)
+	SetTimeInForce(tif TimeInForce, expireTime int64)
+	SetPostOnly(postOnly bool, mode PostOnlyMode)
+	SetAccount(accountId string, stpMode STPMode)
+	SetClientOrderId(clientOrderId string)
+	SetDisplayQuantity(displayQty int64)
+	SetHiddenQuantity(hiddenQty int64)
+	Hide()
+	Replenish() bool
 	Less(item HeapItem) bool
-	GetIndex() int
+	GetSequence() int64
 	GetUniqueId() string
-	GetPrice() decimal.Decimal
-	GetQuantity() decimal.Decimal
+	GetPrice() int64
+	GetQuantity() int64
 	GetCreateTime() int64
 	GetOrderSide() OrderSide
 	GetPriceType() PriceType
+	GetAmount() int64
+	GetTimeInForce() TimeInForce
+	GetExpireTime() int64
+	GetStopPrice() int64
+	GetDisplayQuantity() int64
+	GetHiddenQuantity() int64
+	GetAccountId() string
+	GetClientOrderId() string
+	GetSTPMode() STPMode
+	IsPostOnly() bool
+	GetPostOnlyMode() PostOnlyMode
 }
-
-type ExtendedHeap []HeapItem
-
-func (heap ExtendedHeap) Len() int { return len(heap) }
-
-func (heap *ExtendedHeap) Pop() interface{} {
-	old := *heap
-	n := len(old)
-	item := old[n-1]
-	item.SetIndex(-1)
-	*heap = old[0 : n-1]
-	return item
-}
-
-func (heap *ExtendedHeap) Push(x interface{}) {
-	n := len(*heap)
-	x.(HeapItem).SetIndex(n)
-	*heap = append(*heap, x.(HeapItem))
-}
-
-func (heap ExtendedHeap) Less(i, j int) bool {
-	return heap[i].Less(heap[j])
-}
-
-func (heap ExtendedHeap) Swap(i, j int) {
-	heap[i], heap[j] = heap[j], heap[i]
-	heap[i].SetIndex(i)
-	heap[j].SetIndex(j)
-}
-
-func NewOrderBook() *Orderbook {
-	h := make(ExtendedHeap, 0)
-	heap.Init(&h)
-
-	queue := Orderbook{
-		h: &h,
-		m: make(map[string]*HeapItem),
-	}
-	return &queue
-}
-
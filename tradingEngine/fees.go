@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	FeeTierDefault    = "default"
+	FeeAccountDefault = "fees"
+)
+
+// fee rates are held in millionths
+const feeDigit = 6
+
+var ErrFeeTier = errors.New("unknown_fee_tier")
+
+// FeeRate is what the maker and the taker of a trade pay, as a fraction of
+// what they receive, e.g. 0.001 for 0.1%.
+type FeeRate struct {
+	Maker decimal.Decimal `json:"maker"`
+	Taker decimal.Decimal `json:"taker"`
+}
+
+type feeRate struct {
+	maker int64
+	taker int64
+}
+
+// SetAccountTier queues the fee tier of an account.
+func (t *TradePair) SetAccountTier(accountId, tier string) CommandResult {
+	return t.submit(Command{
+		Type:      CommandSetAccountTier,
+		AccountId: accountId,
+		Tier:      tier,
+	})
+}
+
+func (t *TradePair) handlerSetAccountTier(accountId, tier string) string {
+	if accountId == "" {
+		return RejectReasonNoAccount
+	}
+	if tier == "" || tier == FeeTierDefault {
+		delete(t.tiers, accountId)
+		return ""
+	}
+	if _, ok := t.rules.fees[tier]; !ok {
+		return ErrFeeTier.Error()
+	}
+	t.tiers[accountId] = tier
+	return ""
+}
+
+// FeesFromEnv reads the fee schedule of the pair from fees, a comma separated
+// list of tier:maker:taker, e.g. "default:0.001:0.002,vip:0:0.001".
+func FeesFromEnv(symbol string) (map[string]FeeRate, error) {
+	key, v := pairEnv(symbol, "fees")
+	if v == "" {
+		return nil, nil
+	}
+
+	fees := make(map[string]FeeRate)
+	for _, entry := range strings.Split(v, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %q", key, v)
+		}
+		maker, err := string2decimal(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, v)
+		}
+		taker, err := string2decimal(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, v)
+		}
+		fees[parts[0]] = FeeRate{Maker: maker, Taker: taker}
+	}
+	return fees, nil
+}
+
+// setFees scales the fee schedule. Trades of accounts without a tier, or of
+// a schedule without a default tier, are free.
+func (r *tradingRules) setFees(rules TradingRules) error {
+	r.fees = make(map[string]feeRate)
+	for tier, rate := range rules.Fees {
+		maker, err := scaleDecimal(rate.Maker, feeDigit, ErrInvalidNumber)
+		if err != nil {
+			return fmt.Errorf("%s maker fee %s: %s", tier, rate.Maker, err)
+		}
+		taker, err := scaleDecimal(rate.Taker, feeDigit, ErrInvalidNumber)
+		if err != nil {
+			return fmt.Errorf("%s taker fee %s: %s", tier, rate.Taker, err)
+		}
+		if maker > 1e6 || taker > 1e6 {
+			return fmt.Errorf("%s fee above 1", tier)
+		}
+		r.fees[tier] = feeRate{maker: maker, taker: taker}
+	}
+
+	r.feeAccount = rules.FeeAccount
+	if r.feeAccount == "" {
+		r.feeAccount = FeeAccountDefault
+	}
+	return nil
+}
+
+// feeRate is the rate the account pays as maker or taker.
+func (t *TradePair) feeRate(accountId string, maker bool) int64 {
+	tier, ok := t.tiers[accountId]
+	if !ok {
+		tier = FeeTierDefault
+	}
+	rate := t.rules.fees[tier]
+	if maker {
+		return rate.maker
+	}
+	return rate.taker
+}
+
+// fee is the part of v taken at rate, rounded down to the unit.
+func fee(v, rate int64) int64 {
+	hi, lo := bits.Mul64(uint64(v), uint64(rate))
+	q, _ := bits.Div64(hi, lo, 1e6)
+	return int64(q)
+}
+
+// tradeFees works out what each side of a trade pays. The seller is charged
+// in quote from what it is paid and the buyer in base from what it gets.
+func (t *TradePair) tradeFees(ask, bid HeapItem, price, quantity int64, takerSide OrderSide) (askFee, bidFee int64) {
+	askFee = fee(price*quantity, t.feeRate(ask.GetAccountId(), takerSide != OrderSideSell))
+	bidFee = fee(quantity, t.feeRate(bid.GetAccountId(), takerSide != OrderSideBuy))
+	return askFee, bidFee
+}
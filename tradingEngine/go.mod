@@ -1,4 +1,4 @@
-module main
+module tradingEngine
 
 go 1.20
 
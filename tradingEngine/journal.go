@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// Journal config
+var (
+	dataDir       = flag.String("data-dir", "data", "directory holding the journal of each pair (empty disables journaling)")
+	fsyncPolicy   = flag.String("fsync", FsyncInterval, "journal fsync policy - always|interval|never")
+	fsyncInterval = flag.Duration("fsync-interval", 100*time.Millisecond, "how often the journal is synced under the interval policy")
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	RecordCommand      = "command"
+	RecordTrade        = "trade"
+	RecordCancel       = "cancel"
+	RecordPostOnly     = "post_only"
+	RecordAmend        = "amend"
+	RecordSTP          = "self_trade_prevention"
+	RecordReject       = "reject"
+	RecordStatus       = "status"
+	RecordBand         = "price_band"
+	RecordExecution    = "execution_report"
+	RecordCommandEvent = "command_result"
+)
+
+// OrderRecord is the serialisable form of an order as it was submitted.
+type OrderRecord struct {
+	OrderSide    OrderSide       `json:"order_side"`
+	OrderId      string          `json:"order_id"`
+	PriceType    PriceType       `json:"price_type"`
+	Price        decimal.Decimal `json:"price"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	Amount       decimal.Decimal `json:"amount"`
+	CreateTime   int64           `json:"create_time"`
+	StopPrice    decimal.Decimal `json:"stop_price"`
+	DisplayQty   decimal.Decimal `json:"display_quantity"`
+	TimeInForce  TimeInForce     `json:"time_in_force"`
+	ExpireTime   int64           `json:"expire_time"`
+	PostOnly     bool            `json:"post_only"`
+	PostOnlyMode PostOnlyMode    `json:"post_only_mode"`
+	AccountId    string          `json:"account_id"`
+	STPMode      STPMode         `json:"stp_mode"`
+	ClientId     string          `json:"client_order_id,omitempty"`
+
+	// only set for orders resting in a snapshot
+	HiddenQty decimal.Decimal `json:"hidden_quantity"`
+	Sequence  int64           `json:"sequence,omitempty"`
+}
+
+// orderRecord writes an order out in decimal units, so the journal does not
+// depend on how the book scales prices and quantities.
+func (t *TradePair) orderRecord(item HeapItem) *OrderRecord {
+	return &OrderRecord{
+		OrderSide:    item.GetOrderSide(),
+		OrderId:      item.GetUniqueId(),
+		PriceType:    item.GetPriceType(),
+		Price:        t.TicksToPrice(item.GetPrice()),
+		Quantity:     t.LotsToQty(item.GetQuantity()),
+		Amount:       t.UnitsToAmount(item.GetAmount()),
+		CreateTime:   item.GetCreateTime(),
+		StopPrice:    t.TicksToPrice(item.GetStopPrice()),
+		DisplayQty:   t.LotsToQty(item.GetDisplayQuantity()),
+		TimeInForce:  item.GetTimeInForce(),
+		ExpireTime:   item.GetExpireTime(),
+		PostOnly:     item.IsPostOnly(),
+		PostOnlyMode: item.GetPostOnlyMode(),
+		AccountId:    item.GetAccountId(),
+		STPMode:      item.GetSTPMode(),
+		ClientId:     item.GetClientOrderId(),
+		HiddenQty:    t.LotsToQty(item.GetHiddenQuantity()),
+		Sequence:     item.GetSequence(),
+	}
+}
+
+func (t *TradePair) recordItem(r *OrderRecord) HeapItem {
+	price, quantity, amount := t.PriceTicks(r.Price), t.QtyLots(r.Quantity), t.AmountUnits(r.Amount)
+	var item HeapItem
+	if r.OrderSide == OrderSideSell {
+		item = NewAskItem(r.PriceType, r.OrderId, price, quantity, amount, r.CreateTime)
+	} else {
+		item = NewBidItem(r.PriceType, r.OrderId, price, quantity, amount, r.CreateTime)
+	}
+	item.SetStopPrice(t.PriceTicks(r.StopPrice))
+	item.SetDisplayQuantity(t.QtyLots(r.DisplayQty))
+	item.SetTimeInForce(r.TimeInForce, r.ExpireTime)
+	item.SetPostOnly(r.PostOnly, r.PostOnlyMode)
+	item.SetAccount(r.AccountId, r.STPMode)
+	item.SetClientOrderId(r.ClientId)
+	item.SetHiddenQuantity(t.QtyLots(r.HiddenQty))
+	item.SetSequence(r.Sequence)
+	return item
+}
+
+// JournalRecord is one line of the journal. Command records are what the
+// book is rebuilt from; the outputs they produced are kept alongside them.
+type JournalRecord struct {
+	Kind      string `json:"kind"`
+	Sequence  int64  `json:"sequence"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+
+	Type     CommandType   `json:"type,omitempty"`
+	Order    *OrderRecord  `json:"order,omitempty"`
+	OrderId  string        `json:"order_id,omitempty"`
+	ClientId string        `json:"client_order_id,omitempty"`
+	Amend    *AmendRequest `json:"amend,omitempty"`
+
+	AccountId string  `json:"account_id,omitempty"`
+	STPMode   STPMode `json:"stp_mode,omitempty"`
+	Tier      string  `json:"tier,omitempty"`
+
+	Status   PairStatus `json:"status,omitempty"`
+	Duration int64      `json:"duration,omitempty"`
+
+	Transfer *TransferRecord `json:"transfer,omitempty"`
+
+	Trade    *TradeResult    `json:"trade,omitempty"`
+	Cancel   *CancelResult   `json:"cancel,omitempty"`
+	PostOnly *PostOnlyResult `json:"post_only,omitempty"`
+
+	AmendResult *AmendResult  `json:"amend_result,omitempty"`
+	STP         *STPResult    `json:"stp,omitempty"`
+	Reject      *RejectResult `json:"reject,omitempty"`
+
+	StatusResult *StatusResult    `json:"status_result,omitempty"`
+	Band         *BandResult      `json:"band,omitempty"`
+	Execution    *ExecutionReport `json:"execution,omitempty"`
+	CommandEvent *CommandEvent    `json:"command_result,omitempty"`
+}
+
+func (t *TradePair) recordCommand(r *JournalRecord) Command {
+	cmd := Command{
+		Type:      r.Type,
+		Sequence:  r.Sequence,
+		Timestamp: r.Timestamp,
+		OrderId:   r.OrderId,
+		ClientId:  r.ClientId,
+		Amend:     r.Amend,
+		AccountId: r.AccountId,
+		Status:    r.Status,
+		Duration:  r.Duration,
+		STPMode:   r.STPMode,
+		Tier:      r.Tier,
+	}
+	if r.Order != nil {
+		cmd.Order = t.recordItem(r.Order)
+	}
+	if r.Transfer != nil {
+		cmd.Asset = r.Transfer.Asset
+		cmd.Amount = t.assetUnits(r.Transfer.Asset, r.Transfer.Amount)
+	}
+	return cmd
+}
+
+// Journal is an append-only file of JSON records, one per line.
+type Journal struct {
+	sync.Mutex
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	policy string
+}
+
+// checkFsync refuses a policy the journal does not know, and an interval
+// policy that would never sync.
+func checkFsync(policy string, interval time.Duration) error {
+	switch policy {
+	case FsyncAlways, FsyncNever:
+	case FsyncInterval:
+		if interval <= 0 {
+			return fmt.Errorf("invalid fsync interval %s", interval)
+		}
+	default:
+		return fmt.Errorf("invalid fsync policy %q, want %s, %s or %s", policy, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+	return nil
+}
+
+func OpenJournal(path, policy string, interval time.Duration) (*Journal, error) {
+	if err := checkFsync(policy, interval); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Journal dir: %s", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Journal open: %s", err)
+	}
+
+	j := &Journal{
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		policy: policy,
+	}
+
+	if policy == FsyncInterval {
+		go j.syncLoop(interval)
+	}
+	return j, nil
+}
+
+// Replay feeds every record to fn in the order they were written. A torn
+// record at the tail, left behind by a crash in the middle of a write, is cut
+// off so that new records are appended after the last good one.
+func (j *Journal) Replay(fn func(rec JournalRecord) error) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(j.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+
+		var rec JournalRecord
+		if err != nil || json.Unmarshal(line, &rec) != nil {
+			logrus.Warnf("journal: dropping torn record at offset %d", offset)
+			if err := j.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+
+	_, err := j.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (j *Journal) Append(rec JournalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if _, err := j.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Commit hands everything appended so far to the OS, and waits for it to hit
+// the disk under the always policy.
+func (j *Journal) Commit() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	if j.policy == FsyncAlways {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+func (j *Journal) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		<-ticker.C
+		if err := j.sync(); err != nil {
+			logrus.Errorf("journal sync: %s", err)
+		}
+	}
+}
+
+func (j *Journal) sync() error {
+	j.Lock()
+	defer j.Unlock()
+
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Rotate moves everything journaled so far to archive and carries on in a
+// new, empty file.
+func (j *Journal) Rotate(archive string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if err := j.writer.Flush(); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path, archive); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("Journal open: %s", err)
+	}
+	j.file = file
+	j.writer.Reset(file)
+	return syncDir(filepath.Dir(j.path))
+}
+
+// syncDir makes the files just created or renamed in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *Journal) Close() error {
+	if err := j.sync(); err != nil {
+		return err
+	}
+	return j.file.Close()
+}
+
+// openJournal opens the journal of the pair and rebuilds the book from the
+// latest snapshot and the commands journaled after it, in the segments the
+// journal was rotated into and then in the journal itself.
+func (t *TradePair) openJournal() {
+	if *dataDir == "" {
+		return
+	}
+
+	path := filepath.Join(*dataDir, t.Symbol+".journal")
+	journal, err := OpenJournal(path, *fsyncPolicy, *fsyncInterval)
+	if err != nil {
+		logrus.Fatalf("%s", err)
+	}
+
+	snapshotSeq := t.loadSnapshot()
+
+	t.replaying = true
+	replay := func(rec JournalRecord) error {
+		switch rec.Kind {
+		case RecordCommand:
+			if rec.Sequence > snapshotSeq {
+				t.apply(t.recordCommand(&rec))
+			}
+		case RecordTrade:
+			t.replayedTrades = append(t.replayedTrades, *rec.Trade)
+			if len(t.replayedTrades) > 10 {
+				t.replayedTrades = t.replayedTrades[1:]
+			}
+		}
+		return nil
+	}
+	for _, segment := range journalSegments(t.Symbol) {
+		if err := replaySegment(segment, replay); err != nil {
+			logrus.Fatalf("journal replay: %s", err)
+		}
+	}
+	err = journal.Replay(replay)
+	t.replaying = false
+	if err != nil {
+		logrus.Fatalf("journal replay: %s", err)
+	}
+
+	logrus.Infof("%s replayed journal up to sequence %d", t.Symbol, t.sequence)
+	t.journal = journal
+}
+
+func replaySegment(path string, fn func(rec JournalRecord) error) error {
+	segment, err := OpenJournal(path, FsyncNever, 0)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+	return segment.Replay(fn)
+}
+
+// segmentPath is where the journal is moved when it is rotated right after
+// the snapshot at sequence. The segment ends with that command.
+func segmentPath(symbol string, sequence int64) string {
+	return filepath.Join(*dataDir, fmt.Sprintf("%s-%020d.journal", symbol, sequence))
+}
+
+// journalSegments returns the rotated segments of the journal of a pair,
+// oldest first.
+func journalSegments(symbol string) []string {
+	return sequencedFiles(symbol, ".journal")
+}
+
+// sequencedFiles returns the files of a pair named <symbol>-<sequence><ext>,
+// oldest first. Only that exact form matches, so the files of a pair whose
+// symbol merely starts the same are never picked up.
+func sequencedFiles(symbol, ext string) []string {
+	files, _ := filepath.Glob(filepath.Join(*dataDir, symbol+"-"+strings.Repeat("[0-9]", 20)+ext))
+	sort.Strings(files)
+	return files
+}
+
+// fileSequence reads the sequence a snapshot or a journal segment was named
+// after.
+func fileSequence(path string) int64 {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	seq, _ := strconv.ParseInt(name[strings.LastIndex(name, "-")+1:], 10, 64)
+	return seq
+}
+
+// rotateJournal starts a new journal once the snapshot at sequence is on disk,
+// and drops the segments no snapshot still kept needs to be replayed.
+func (t *TradePair) rotateJournal(sequence int64) error {
+	if t.journal == nil {
+		return nil
+	}
+	// Nothing was journaled since the last snapshot at the same sequence
+	segment := segmentPath(t.Symbol, sequence)
+	if _, err := os.Stat(segment); err == nil {
+		return nil
+	}
+	if err := t.journal.Rotate(segment); err != nil {
+		return err
+	}
+
+	snapshots := listSnapshots(t.Symbol)
+	if len(snapshots) == 0 {
+		return nil
+	}
+	oldest := fileSequence(snapshots[0])
+	for _, old := range journalSegments(t.Symbol) {
+		if fileSequence(old) <= oldest {
+			os.Remove(old)
+		}
+	}
+	return nil
+}
+
+// record appends a record to the journal unless the pair is replaying it.
+func (t *TradePair) record(rec JournalRecord) {
+	if t.journal == nil || t.replaying {
+		return
+	}
+	if err := t.journal.Append(rec); err != nil {
+		logrus.Errorf("journal append: %s", err)
+	}
+}
+
+// output journals a result of the command being applied and hands it on
+// behind every result produced before it.
+func (t *TradePair) output(rec JournalRecord) {
+	t.record(rec)
+	t.ChOutput <- rec
+}
+
+func (t *TradePair) commitJournal() {
+	if t.journal == nil || t.replaying {
+		return
+	}
+	if err := t.journal.Commit(); err != nil {
+		logrus.Errorf("journal commit: %s", err)
+	}
+}
+
+// RecentTrades returns the last trades found in the journal at startup.
+func (t *TradePair) RecentTrades() []TradeResult {
+	return t.replayedTrades
+}
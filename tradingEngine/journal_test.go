@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// state is the snapshot of the pair as JSON, without the time it was taken.
+func state(t *testing.T, pair *TradePair) string {
+	pair.w.Lock()
+	defer pair.w.Unlock()
+
+	s := pair.snapshot()
+	s.Timestamp = 0
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// crash stops the pair the way a killed process would, with the journal
+// flushed but no snapshot written.
+func crash(t *testing.T, pair *TradePair) {
+	pair.w.Lock()
+	if err := pair.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rules := TradingRules{
+		Fees: map[string]FeeRate{FeeTierDefault: {Maker: dec("0.001"), Taker: dec("0.002")}},
+	}
+	tests := []struct {
+		name string
+		run  func(pair *TradePair)
+	}{
+		{
+			name: "trades and resting orders",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "2")
+				limit(pair, "a-2", "101", "1")
+				limit(pair, "b-1", "100.5", "3")
+				limit(pair, "b-2", "99", "1")
+			},
+		},
+		{
+			name: "cancels, amends and expiries",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "2", clientId("c-1"))
+				limit(pair, "a-2", "102", "1", clientId("c-2"))
+				limit(pair, "b-1", "99", "1", expireAt(time.Now().Add(time.Hour).UnixNano()), clientId("c-1"))
+				pair.CancelOrder("a-2")
+				pair.AmendOrder("a-1", "seller", dec("101"), dec("1"))
+				limit(pair, "b-2", "98", "1", expireAt(1))
+			},
+		},
+		{
+			name: "stops, icebergs and self-trade prevention",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "3", display("1"))
+				fund(pair, "stopper")
+				place(pair, PriceTypeStopLimit, "b-s", "101", "1", stopAt("100"), account("stopper", STPNone))
+				limit(pair, "b-1", "100", "2")
+				limit(pair, "b-2", "100", "1", account("seller", STPCancelNewest))
+			},
+		},
+		{
+			name: "auction, tiers and transfers",
+			run: func(pair *TradePair) {
+				pair.SetAccountTier("buyer", FeeTierDefault)
+				pair.StartAuction(0)
+				limit(pair, "a-1", "100", "2")
+				limit(pair, "b-1", "101", "1")
+				pair.SetStatus(PairStatusOpen)
+				pair.Transfer("seller", AssetQuote, pair.AmountUnits(decimal.NewFromInt(-100)))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+" from the journal", func(t *testing.T) {
+			pair := testPair(t, rules)
+			tt.run(pair)
+			want := state(t, pair)
+			crash(t, pair)
+
+			replayed := reopen(t, rules)
+			if got := state(t, replayed); got != want {
+				t.Errorf("replayed state differs\n got %s\nwant %s", got, want)
+			}
+		})
+
+		t.Run(tt.name+" from a snapshot and the journal", func(t *testing.T) {
+			pair := testPair(t, rules)
+			limit(pair, "a-0", "150", "1")
+			limit(pair, "b-0", "50", "1")
+			if err := pair.WriteSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+			tt.run(pair)
+			want := state(t, pair)
+			crash(t, pair)
+
+			replayed := reopen(t, rules)
+			if got := state(t, replayed); got != want {
+				t.Errorf("replayed state differs\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+// reopen starts the pair again from what is in the data directory.
+func reopen(t *testing.T, rules TradingRules) *TradePair {
+	pair, err := NewTradePair("test", 2, 4, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go drain(pair)
+	return pair
+}
+
+func TestJournalRotation(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	for i := 1; i <= 5; i++ {
+		limit(pair, fmt.Sprintf("a-%d", i), "100", "1")
+		limit(pair, fmt.Sprintf("b-%d", i), "99", "1")
+		if err := pair.WriteSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Writing a snapshot again at the same sequence keeps the segment
+	if err := pair.WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	limit(pair, "b-6", "100", "1")
+	want := state(t, pair)
+	crash(t, pair)
+
+	snapshots, segments := listSnapshots("test"), journalSegments("test")
+	if len(snapshots) != snapshotKeep || len(segments) != snapshotKeep-1 {
+		t.Fatalf("%d snapshots and %d segments kept, want %d and %d", len(snapshots), len(segments), snapshotKeep, snapshotKeep-1)
+	}
+
+	// The latest snapshot is lost, the one before it and the segments
+	// rotated since still give the same state
+	if err := os.WriteFile(snapshots[len(snapshots)-1], []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := state(t, reopen(t, TradingRules{})); got != want {
+		t.Errorf("replayed state differs\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestSequencedFiles(t *testing.T) {
+	*dataDir = t.TempDir()
+	for _, name := range []string{
+		"btc-00000000000000000001.journal",
+		"btc-00000000000000000002.journal",
+		"btc_usdt-00000000000000000001.journal",
+		"btc-usdt-00000000000000000001.journal",
+		"btc-1.journal",
+		"btc-00000000000000000001.snapshot",
+	} {
+		if err := os.WriteFile(filepath.Join(*dataDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := journalSegments("btc")
+	want := []string{
+		filepath.Join(*dataDir, "btc-00000000000000000001.journal"),
+		filepath.Join(*dataDir, "btc-00000000000000000002.journal"),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("segments of btc: got %v, want %v", got, want)
+	}
+	if got := listSnapshots("btc"); len(got) != 1 {
+		t.Errorf("snapshots of btc: got %v", got)
+	}
+}
+
+func TestOpenJournalFsync(t *testing.T) {
+	tests := []struct {
+		policy   string
+		interval time.Duration
+		ok       bool
+	}{
+		{FsyncAlways, 0, true},
+		{FsyncInterval, time.Millisecond, true},
+		{FsyncNever, 0, true},
+		{FsyncInterval, 0, false},
+		{"Always", 0, false},
+		{"sometimes", 0, false},
+	}
+	for _, tt := range tests {
+		j, err := OpenJournal(filepath.Join(t.TempDir(), "test.journal"), tt.policy, tt.interval)
+		if (err == nil) != tt.ok {
+			t.Errorf("policy %q, interval %s: got error %v", tt.policy, tt.interval, err)
+		}
+		if j != nil {
+			j.Close()
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CancelReasonDelisted    = "delisted"
+	CancelReasonNotMatching = "matching_halted"
+
+	RejectReasonCancelOnly = "cancel_only"
+	RejectReasonDelisted   = "delisted"
+
+	RejectReasonSameStatus = "status_unchanged"
+)
+
+// StatusResult reports a change of the trading status of a pair.
+type StatusResult struct {
+	Symbol         string `json:"symbol"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status"`
+	Sequence       int64  `json:"sequence"`
+}
+
+// SetStatus queues a move of the pair to another trading status.
+func (t *TradePair) SetStatus(status PairStatus) CommandResult {
+	return t.submit(Command{
+		Type:   CommandSetStatus,
+		Status: status,
+	})
+}
+
+func (t *TradePair) Status() PairStatus {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	return t.status
+}
+
+// handlerSetStatus moves the pair to status. A delisted pair stays delisted.
+// Reopening uncrosses whatever was collected while matching was stopped, and
+// delisting cancels everything on the book. An auction or halt given a
+// duration ends by itself.
+func (t *TradePair) handlerSetStatus(status PairStatus, duration int64) string {
+	if t.status == PairStatusDelisted {
+		return RejectReasonDelisted
+	}
+	if t.status == status && status != PairStatusAuction {
+		return RejectReasonSameStatus
+	}
+
+	previous := t.status
+	t.status = status
+	t.auctionEnd = 0
+	if (status == PairStatusAuction || status == PairStatusHalted) && duration > 0 {
+		t.auctionEnd = t.timestamp + duration
+	}
+	t.sendStatusNotify(previous)
+
+	switch status {
+	case PairStatusOpen:
+		t.uncross()
+		t.triggerStops()
+	case PairStatusDelisted:
+		t.cancelAll(CancelReasonDelisted)
+	}
+	return ""
+}
+
+// statusReject is the reason a new order is refused in the current status.
+func (t *TradePair) statusReject() string {
+	switch t.status {
+	case PairStatusCancelOnly:
+		return RejectReasonCancelOnly
+	case PairStatusDelisted:
+		return RejectReasonDelisted
+	}
+	return ""
+}
+
+// restOrder places an order while the pair is not matching. Orders that
+// would have to trade straight away are cancelled instead. It returns the
+// reason a post-only order was rejected, or an empty string.
+func (t *TradePair) restOrder(order HeapItem) string {
+	tif := order.GetTimeInForce()
+	if order.GetPriceType() == PriceTypeMarket || tif == TimeInForceIOC || tif == TimeInForceFOK {
+		t.sendCancelNotify(order.GetUniqueId(), CancelReasonNotMatching)
+		return ""
+	}
+
+	if order.IsPostOnly() {
+		if reason := t.handlerPostOnly(order); reason != "" {
+			return reason
+		}
+	}
+
+	if tif == TimeInForceGTD {
+		if order.GetExpireTime() <= t.timestamp {
+			t.sendCancelNotify(order.GetUniqueId(), CancelReasonExpired)
+			return ""
+		}
+		t.expiries[order.GetUniqueId()] = order.GetExpireTime()
+	}
+	t.pushOrder(order)
+	return ""
+}
+
+// cancelAll takes every resting and stop order off the pair.
+func (t *TradePair) cancelAll(reason string) {
+	ids := []string{}
+	for _, book := range []*Orderbook{t.BidsOrderbook, t.AsksOrderbook} {
+		book.Walk(func(item HeapItem) bool {
+			ids = append(ids, item.GetUniqueId())
+			return true
+		})
+	}
+	for _, item := range t.StopBook.List() {
+		ids = append(ids, item.GetUniqueId())
+	}
+
+	for _, uniq := range ids {
+		if t.removeOrder(uniq) != nil {
+			t.sendCancelNotify(uniq, reason)
+		}
+	}
+}
+
+func (t *TradePair) sendStatusNotify(previous PairStatus) {
+	if t.replaying {
+		return
+	}
+
+	result := StatusResult{
+		Symbol:         t.Symbol,
+		Status:         PairStatus2String(t.status),
+		PreviousStatus: PairStatus2String(previous),
+		Sequence:       t.sequence,
+	}
+
+	logrus.Infof("%s status %s -> %s", t.Symbol, result.PreviousStatus, result.Status)
+	t.output(JournalRecord{Kind: RecordStatus, Sequence: t.sequence, StatusResult: &result})
+}
@@ -5,80 +5,121 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"main/wss"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"tradingEngine/wss"
 )
 
 type PriceType int
 type OrderSide int
-
-var pairs *string
-var priceDigit *int
-var quantityDigit *int
+type TimeInForce int
+type PostOnlyMode int
+type STPMode int
+type PairStatus int
 
 const (
-	PriceTypeLimit PriceType = 0
+	PriceTypeLimit     PriceType = 0
+	PriceTypeMarket    PriceType = 1
+	PriceTypeStop      PriceType = 2
+	PriceTypeStopLimit PriceType = 3
 
 	OrderSideBuy  OrderSide = 0
 	OrderSideSell OrderSide = 1
-)
 
-var sendMsg chan []byte
-var tradingServices *TradePair
-var recentTrade []interface{}
+	TimeInForceGTC TimeInForce = 0
+	TimeInForceIOC TimeInForce = 1
+	TimeInForceFOK TimeInForce = 2
+	TimeInForceGTD TimeInForce = 3
+
+	PostOnlyReject PostOnlyMode = 0
+	PostOnlySlide  PostOnlyMode = 1
+
+	STPNone            STPMode = 0
+	STPCancelNewest    STPMode = 1
+	STPCancelOldest    STPMode = 2
+	STPCancelBoth      STPMode = 3
+	STPDecrementCancel STPMode = 4
+
+	PairStatusOpen       PairStatus = 0
+	PairStatusPreOpen    PairStatus = 1
+	PairStatusHalted     PairStatus = 2
+	PairStatusCancelOnly PairStatus = 3
+	PairStatusDelisted   PairStatus = 4
+	PairStatusAuction    PairStatus = 5
+)
 
-var web *gin.Engine
+var sendMsg chan wsMessage
+var registry *Registry
+var hubs = make(map[string]*wss.Hub)
+var hubsLock sync.RWMutex
 
-func init() {
-	pairEnv := os.Getenv("pairs")
-	priceDigitEnv := os.Getenv("priceDigit")
-	quantityDigitEnv := os.Getenv("quantityDigit")
+// the last trades of each pair as shown by /trade_log
+var recentTrade = make(map[string][]interface{})
+var recentTradeLock sync.Mutex
 
-	// Case: no env
-	if len(pairEnv) == 0 {
-		pairEnv = "tradingServices"
-		pairs = &pairEnv
+var web *gin.Engine
 
-		priceDigit = new(int)
-		*priceDigit = 2
+// wsMessage is a message for the websocket clients of one pair.
+type wsMessage struct {
+	symbol string
+	data   []byte
+}
 
-		quantityDigit = new(int)
-		*quantityDigit = 4
+func main() {
+	port := flag.String("port", "8080", "port")
+	adminPort := flag.String("admin-port", "8081", "port of the admin endpoints, not to be exposed publicly")
+	inspect := flag.String("inspect-snapshot", "", "print the content of a snapshot file and exit")
+	flag.Parse()
 
-	} else {
-		// Case: With env
-		pairs = &pairEnv
-		if len(priceDigitEnv) != 0 {
-			i64, _ := strconv.Atoi(priceDigitEnv)
-			priceDigit = &i64
+	if *inspect != "" {
+		if err := InspectSnapshot(*inspect, os.Stdout); err != nil {
+			log.Fatalf("%s", err)
 		}
+		return
+	}
 
-		if len(quantityDigitEnv) != 0 {
-			i64, _ := strconv.Atoi(quantityDigitEnv)
-			quantityDigit = &i64
-		}
+	if err := checkFsync(*fsyncPolicy, *fsyncInterval); err != nil {
+		log.Fatalf("%s", err)
 	}
-}
 
-func main() {
-	port := flag.String("port", "8080", "port")
-	flag.Parse()
 	gin.SetMode(gin.DebugMode)
 
-	tradingServices = NewTradePair(*pairs, *priceDigit, *quantityDigit)
-	recentTrade = make([]interface{}, 0)
+	configs, err := PairConfigsFromEnv()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	registry = NewRegistry()
+	for _, cfg := range configs {
+		if _, err := registry.Add(cfg); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if err := registry.LoadCreated(); err != nil {
+		log.Fatalf("%s", err)
+	}
 
 	go func() {
 		log.Println(http.ListenAndServe(":6060", nil))
 	}()
 
-	startWebServices(*port)
+	// Snapshot the book on the way out
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		registry.Shutdown()
+		os.Exit(0)
+	}()
+
+	startWebServices(*port, *adminPort)
 }
 
 func CORSMiddleware() gin.HandlerFunc {
@@ -98,35 +139,46 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-func startWebServices(port string) {
+func startWebServices(port, adminPort string) {
 	web = gin.New()
 	web.Use(CORSMiddleware())
-	sendMsg = make(chan []byte, 100)
+	sendMsg = make(chan wsMessage, 100)
+
+	for _, pair := range registry.All() {
+		servePair(pair)
+	}
 
 	go pushDepth()
-	go watchTradeLog()
-	go MQStart()
+	go MQStart(registry.All())
+
+	web.GET("/api/pairs", pairs)
+	web.GET("/api/orders/:id", order)
+	web.GET("/api/:symbol/depth", depth)
+	web.GET("/api/:symbol/trade_log", trade_log)
+	web.POST("/api/:symbol/cancel_order", cancelOrder)
+	web.POST("/api/:symbol/amend_order", amendOrder)
+	web.GET("/api/:symbol/stop_orders", stopOrders)
+	web.POST("/api/:symbol/cancel_stop_order", cancelStopOrder)
+	web.GET("/api/:symbol/auction", auction)
+	web.POST("/api/:symbol/check_order", checkOrder)
 
-	web.GET("/api/depth", depth)
-	web.GET("/api/trade_log", trade_log)
-	web.POST("/api/cancel_order", cancelOrder)
+	go startAdmin(adminPort)
 
 	//websocket
 	{
-		wss.HHub = wss.NewHub()
-		go wss.HHub.Run()
 		go func() {
-			for {
-				select {
-				case data := <-sendMsg:
-					wss.HHub.Send(data)
-				default:
-					time.Sleep(time.Duration(100) * time.Millisecond)
+			for msg := range sendMsg {
+				if hub := pairHub(msg.symbol); hub != nil {
+					hub.Send(msg.data)
 				}
 			}
 		}()
 
-		web.GET("/ws", wss.ServeWs)
+		web.GET("/api/:symbol/ws", func(c *gin.Context) {
+			if pair, ok := tradePair(c); ok {
+				wss.ServeWs(pairHub(pair.Symbol), c)
+			}
+		})
 		web.GET("/pong", func(c *gin.Context) {
 			c.JSON(200, gin.H{
 				"message": "pong",
@@ -137,14 +189,70 @@ func startWebServices(port string) {
 	web.Run(":" + port)
 }
 
+// servePair starts the websocket hub and the output of a pair.
+func servePair(pair *TradePair) {
+	recentTradeLock.Lock()
+	recentTrade[pair.Symbol] = make([]interface{}, 0)
+	for _, log := range pair.RecentTrades() {
+		recentTrade[pair.Symbol] = append(recentTrade[pair.Symbol], tradeLog(pair, log))
+	}
+	recentTradeLock.Unlock()
+
+	hub := wss.NewHub()
+	go hub.Run()
+	hubsLock.Lock()
+	hubs[pair.Symbol] = hub
+	hubsLock.Unlock()
+
+	go watchTradeLog(pair)
+}
+
+func pairHub(symbol string) *wss.Hub {
+	hubsLock.RLock()
+	defer hubsLock.RUnlock()
+
+	return hubs[symbol]
+}
+
+// tradePair finds the pair named in the path, answering 404 when there is none.
+func tradePair(c *gin.Context) (*TradePair, bool) {
+	pair, ok := registry.Get(c.Param("symbol"))
+	if !ok {
+		c.AbortWithStatusJSON(404, gin.H{
+			"ok":     false,
+			"reason": "unknown_symbol",
+		})
+	}
+	return pair, ok
+}
+
+func pairs(c *gin.Context) {
+	symbols := []string{}
+	for _, pair := range registry.All() {
+		symbols = append(symbols, pair.Symbol)
+	}
+
+	c.JSON(200, gin.H{
+		"ok": true,
+		"data": gin.H{
+			"pairs": symbols,
+		},
+	})
+}
+
 func depth(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
 	limit := c.Query("limit")
 	limitInt, _ := strconv.Atoi(limit)
 	if limitInt <= 0 || limitInt > 100 {
 		limitInt = 10
 	}
-	a := tradingServices.GetAskDepth(limitInt)
-	b := tradingServices.GetBidDepth(limitInt)
+	a := pair.GetAskDepth(limitInt)
+	b := pair.GetBidDepth(limitInt)
 
 	c.JSON(200, gin.H{
 		"ask": a,
@@ -154,30 +262,161 @@ func depth(c *gin.Context) {
 
 func pushDepth() {
 	for {
-		ask := tradingServices.GetAskDepth(10)
-		bid := tradingServices.GetBidDepth(10)
+		for _, pair := range registry.All() {
+			ask := pair.GetAskDepth(10)
+			bid := pair.GetBidDepth(10)
 
-		sendMessage("depth", gin.H{
-			"ask": ask,
-			"bid": bid,
-		})
+			sendMessage(pair.Symbol, "depth", gin.H{
+				"ask": ask,
+				"bid": bid,
+			})
+
+			if info, ok := pair.Indicative(); ok {
+				sendMessage(pair.Symbol, "auction", auctionInfo(pair, info))
+			}
+		}
 
 		time.Sleep(time.Duration(150) * time.Millisecond)
 	}
 }
 
+func auctionInfo(pair *TradePair, info AuctionInfo) gin.H {
+	return gin.H{
+		"Status":    info.Status,
+		"Price":     pair.Price2String(info.Price),
+		"Volume":    pair.Qty2String(info.Volume),
+		"Imbalance": pair.Qty2String(info.Imbalance),
+		"EndTime":   info.EndTime,
+	}
+}
+
+// auction shows the indicative uncross while the pair collects orders.
+func auction(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	info, collecting := pair.Indicative()
+	if !collecting {
+		c.JSON(200, gin.H{
+			"ok":     false,
+			"reason": "not_in_auction",
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"ok":   true,
+		"data": auctionInfo(pair, info),
+	})
+}
+
 func trade_log(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	recentTradeLock.Lock()
+	trades := append([]interface{}{}, recentTrade[pair.Symbol]...)
+	recentTradeLock.Unlock()
+
 	c.JSON(200, gin.H{
 		"ok": true,
 		"data": gin.H{
-			"trade_log": recentTrade,
+			"trade_log": trades,
 		},
 	})
 }
 
 func cancelOrder(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
 	type args struct {
-		OrderId string `json:"order_id"`
+		OrderId       string `json:"order_id"`
+		ClientOrderId string `json:"client_order_id"`
+		AccountId     string `json:"account_id"`
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	if param.OrderId == "" && (param.ClientOrderId == "" || param.AccountId == "") {
+		c.Abort()
+		return
+	}
+
+	// Signal the tradingEngine to cancel the order, the engine reports the
+	// cancel itself once it has been sequenced
+	var result CommandResult
+	if param.OrderId != "" {
+		result = pair.CancelOrder(param.OrderId)
+	} else {
+		result = pair.CancelClientOrder(param.AccountId, param.ClientOrderId)
+	}
+
+	c.JSON(200, gin.H{
+		"ok":       result.Ok,
+		"reason":   result.Reason,
+		"sequence": result.Sequence,
+	})
+}
+
+// order reports the status of an order, whichever pair it was sent to. With
+// an account_id query the id may also be a client order id of that account.
+func order(c *gin.Context) {
+	for _, pair := range registry.All() {
+		if state, ok := pair.Order(c.Param("id"), c.Query("account_id")); ok {
+			c.JSON(200, gin.H{
+				"ok":   true,
+				"data": state,
+			})
+			return
+		}
+	}
+
+	c.JSON(404, gin.H{"ok": false, "reason": RejectReasonUnknownOrder})
+}
+
+// checkOrder runs the checks a new order goes through before it reaches the
+// book, so the api can turn it away without queueing it.
+func checkOrder(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	var param orderArgs
+	c.BindJSON(&param)
+
+	item, err := parseOrder(pair, &param)
+	if err != nil {
+		c.JSON(200, gin.H{"ok": false, "reason": err.Error()})
+		return
+	}
+	if reason := pair.PreTradeCheck(item); reason != "" {
+		c.JSON(200, gin.H{"ok": false, "reason": reason})
+		return
+	}
+
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func amendOrder(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	type args struct {
+		OrderId   string `json:"order_id"`
+		AccountId string `json:"account_id"`
+		Price     string `json:"price"`
+		Quantity  string `json:"quantity"`
 	}
 
 	var param args
@@ -187,69 +426,274 @@ func cancelOrder(c *gin.Context) {
 		c.Abort()
 		return
 	}
+	// Only the account that sent an order may change it
+	if param.AccountId == "" {
+		c.JSON(400, gin.H{"ok": false, "reason": RejectReasonNoAccount})
+		return
+	}
 
-	// Signal the tradingEngine to cancel the order
-	tradingServices.CancelOrder(param.OrderId)
+	price, err := string2decimal(param.Price)
+	if err != nil {
+		c.JSON(400, gin.H{"ok": false, "reason": RejectReasonInvalidNumber})
+		return
+	}
+	quantity, err := string2decimal(param.Quantity)
+	if err != nil {
+		c.JSON(400, gin.H{"ok": false, "reason": RejectReasonInvalidNumber})
+		return
+	}
 
-	go sendMessage("cancel_order", param)
+	result := pair.AmendOrder(param.OrderId, param.AccountId, price, quantity)
+
+	c.JSON(200, gin.H{
+		"ok":       result.Ok,
+		"reason":   result.Reason,
+		"sequence": result.Sequence,
+	})
+}
+
+func stopOrders(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	orders := []gin.H{}
+	for _, item := range pair.GetStopOrders() {
+		side := "bid"
+		if item.GetOrderSide() == OrderSideSell {
+			side = "ask"
+		}
+		orders = append(orders, gin.H{
+			"order_id":    item.GetUniqueId(),
+			"order_type":  side,
+			"price_type":  PriceType2String(item.GetPriceType()),
+			"stop_price":  pair.Price2String(pair.TicksToPrice(item.GetStopPrice())),
+			"price":       pair.Price2String(pair.TicksToPrice(item.GetPrice())),
+			"quantity":    pair.Qty2String(pair.LotsToQty(item.GetQuantity())),
+			"amount":      pair.Amount2String(pair.UnitsToAmount(item.GetAmount())),
+			"create_time": item.GetCreateTime(),
+		})
+	}
 
 	c.JSON(200, gin.H{
 		"ok": true,
+		"data": gin.H{
+			"stop_orders": orders,
+		},
+	})
+}
+
+func cancelStopOrder(c *gin.Context) {
+	pair, ok := tradePair(c)
+	if !ok {
+		return
+	}
+
+	type args struct {
+		OrderId string `json:"order_id"`
+	}
+
+	var param args
+	c.BindJSON(&param)
+
+	if param.OrderId == "" {
+		c.Abort()
+		return
+	}
+
+	result := pair.CancelStopOrder(param.OrderId)
+
+	c.JSON(200, gin.H{
+		"ok":     result.Ok,
+		"reason": result.Reason,
 	})
 }
 
-func sendMessage(tag string, data interface{}) {
+func sendMessage(symbol string, tag string, data interface{}) {
 	msg := gin.H{
 		"tag":  tag,
 		"data": data,
 	}
 	msgByte, _ := json.Marshal(msg)
-	sendMsg <- []byte(msgByte)
+	sendMsg <- wsMessage{symbol: symbol, data: msgByte}
 }
 
-func watchTradeLog() {
-	for {
-		select {
-		case log, ok := <-tradingServices.ChTradeResult:
-			if ok {
-				relog := gin.H{
-					"TradePrice":    tradingServices.Price2String(log.TradePrice),
-					"TradeAmount":   tradingServices.Price2String(log.TradeAmount),
-					"TradeQuantity": tradingServices.Qty2String(log.TradeQuantity),
-					"TradeTime":     log.TradeTime,
-					"AskOrderId":    log.AskOrderId,
-					"BidOrderId":    log.BidOrderId,
-				}
-				sendMessage("trade", relog)
+func tradeLog(pair *TradePair, log TradeResult) gin.H {
+	return gin.H{
+		"Symbol":        log.Symbol,
+		"TradePrice":    pair.Price2String(log.TradePrice),
+		"TradeAmount":   pair.Amount2String(log.TradeAmount),
+		"TradeQuantity": pair.Qty2String(log.TradeQuantity),
+		"TradeTime":     log.TradeTime,
+		"AskOrderId":    log.AskOrderId,
+		"BidOrderId":    log.BidOrderId,
+		"Sequence":      log.Sequence,
+		"TakerSide":     log.TakerSide,
+		"AskFee":        pair.Amount2String(log.AskFee),
+		"AskFeeAsset":   log.AskFeeAsset,
+		"BidFee":        pair.Qty2String(log.BidFee),
+		"BidFeeAsset":   log.BidFeeAsset,
+	}
+}
 
-				relogJSON, err := json.Marshal(relog)
-				if err != nil {
-					fmt.Println(err.Error())
-					return
-				}
+// watchTradeLog publishes the results of a pair to the websocket hub and the
+// output queue, one at a time in the order the sequencer produced them.
+func watchTradeLog(pair *TradePair) {
+	out := newOutputQueue(pair.Symbol)
+	for rec := range pair.ChOutput {
+		tag, relog := outputMessage(pair, rec)
+		if relog == nil {
+			continue
+		}
+		sendMessage(pair.Symbol, tag, publicMessage(relog))
 
-				jsonStr := string(relogJSON)
+		relogJSON, err := json.Marshal(relog)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		out.Push(string(relogJSON))
 
-				pushToOutputqueue(jsonStr)
+		if rec.Trade == nil {
+			continue
+		}
+		recentTradeLock.Lock()
+		if len(recentTrade[pair.Symbol]) >= 10 {
+			recentTrade[pair.Symbol] = recentTrade[pair.Symbol][1:]
+		}
+		recentTrade[pair.Symbol] = append(recentTrade[pair.Symbol], relog)
+		recentTradeLock.Unlock()
 
-				if len(recentTrade) >= 10 {
-					recentTrade = recentTrade[1:]
-				}
-				recentTrade = append(recentTrade, relog)
+		//latest price
+		sendMessage(pair.Symbol, "latest_price", gin.H{
+			"latest_price": pair.Price2String(rec.Trade.TradePrice),
+		})
+	}
+}
 
-				//latest price
-				sendMessage("latest_price", gin.H{
-					"latest_price": tradingServices.Price2String(log.TradePrice),
-				})
+// fields naming who sent an order, kept off the websocket every client of the
+// pair can subscribe to
+var privateFields = []string{"AccountId", "ClientOrderId"}
 
-			}
-		case cancelOrderId := <-tradingServices.ChCancelResult:
-			sendMessage("cancel_order", gin.H{
-				"OrderId": cancelOrderId,
-			})
-		default:
-			time.Sleep(time.Duration(100) * time.Millisecond)
-		}
+// publicMessage is a result as the websocket shows it, without the fields
+// naming who sent the order. The output queue gets it in full.
+func publicMessage(relog gin.H) gin.H {
+	public := gin.H{}
+	for k, v := range relog {
+		public[k] = v
+	}
+	for _, k := range privateFields {
+		delete(public, k)
+	}
+	return public
+}
 
+// outputMessage is the tag and body a result is published with.
+func outputMessage(pair *TradePair, rec JournalRecord) (string, gin.H) {
+	switch {
+	case rec.Trade != nil:
+		return "trade", tradeLog(pair, *rec.Trade)
+	case rec.PostOnly != nil:
+		result := rec.PostOnly
+		return "post_only", gin.H{
+			"Symbol":        result.Symbol,
+			"OrderId":       result.OrderId,
+			"Action":        result.Action,
+			"OriginalPrice": pair.Price2String(result.OriginalPrice),
+			"Price":         pair.Price2String(result.Price),
+			"Sequence":      result.Sequence,
+		}
+	case rec.AmendResult != nil:
+		result := rec.AmendResult
+		return "amend_order", gin.H{
+			"Symbol":   result.Symbol,
+			"OrderId":  result.OrderId,
+			"Accepted": result.Accepted,
+			"Reason":   result.Reason,
+			"Price":    pair.Price2String(result.Price),
+			"Quantity": pair.Qty2String(result.Quantity),
+			"Sequence": result.Sequence,
+		}
+	case rec.STP != nil:
+		result := rec.STP
+		return "self_trade_prevention", gin.H{
+			"Symbol":       result.Symbol,
+			"Mode":         result.Mode,
+			"TakerOrderId": result.TakerOrderId,
+			"MakerOrderId": result.MakerOrderId,
+			"Quantity":     pair.Qty2String(result.Quantity),
+			"Cancelled":    result.Cancelled,
+			"Sequence":     result.Sequence,
+		}
+	case rec.Reject != nil:
+		result := rec.Reject
+		return "reject_order", gin.H{
+			"Symbol":   result.Symbol,
+			"OrderId":  result.OrderId,
+			"Reason":   result.Reason,
+			"Sequence": result.Sequence,
+		}
+	case rec.StatusResult != nil:
+		result := rec.StatusResult
+		return "pair_status", gin.H{
+			"Symbol":         result.Symbol,
+			"Status":         result.Status,
+			"PreviousStatus": result.PreviousStatus,
+			"Sequence":       result.Sequence,
+		}
+	case rec.Execution != nil:
+		report := rec.Execution
+		return "execution_report", gin.H{
+			"Symbol":         report.Symbol,
+			"OrderId":        report.OrderId,
+			"ClientOrderId":  report.ClientOrderId,
+			"AccountId":      report.AccountId,
+			"ExecType":       report.ExecType,
+			"Status":         report.Status,
+			"Reason":         report.Reason,
+			"Side":           report.Side,
+			"Price":          pair.Price2String(report.Price),
+			"Quantity":       pair.Qty2String(report.Quantity),
+			"FilledQuantity": pair.Qty2String(report.FilledQuantity),
+			"AveragePrice":   pair.Price2String(report.AveragePrice),
+			"LastQuantity":   pair.Qty2String(report.LastQuantity),
+			"LastPrice":      pair.Price2String(report.LastPrice),
+			"Fee":            report.Fee.String(),
+			"FeeAsset":       report.FeeAsset,
+			"Sequence":       report.Sequence,
+		}
+	case rec.Band != nil:
+		result := rec.Band
+		return "price_band", gin.H{
+			"Symbol":    result.Symbol,
+			"OrderId":   result.OrderId,
+			"Price":     pair.Price2String(result.Price),
+			"Low":       pair.Price2String(result.Low),
+			"High":      pair.Price2String(result.High),
+			"Reference": pair.Price2String(result.Reference),
+			"Action":    result.Action,
+			"Sequence":  result.Sequence,
+		}
+	case rec.CommandEvent != nil:
+		event := rec.CommandEvent
+		return "command_result", gin.H{
+			"Symbol":    event.Symbol,
+			"Command":   event.Command,
+			"OrderId":   event.OrderId,
+			"AccountId": event.AccountId,
+			"Accepted":  event.Accepted,
+			"Reason":    event.Reason,
+			"Sequence":  event.Sequence,
+		}
+	case rec.Cancel != nil:
+		cancel := rec.Cancel
+		return "cancel_order", gin.H{
+			"Symbol":   cancel.Symbol,
+			"OrderId":  cancel.OrderId,
+			"Reason":   cancel.Reason,
+			"Sequence": cancel.Sequence,
+		}
 	}
+	return "", nil
 }
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestTradeLogAmount(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	log := tradeLog(pair, TradeResult{
+		TradePrice:    dec("0.01"),
+		TradeQuantity: dec("0.0123"),
+		TradeAmount:   dec("0.000123"),
+	})
+	if got := log["TradeAmount"]; got != "0.000123" {
+		t.Errorf("TradeAmount %v, want 0.000123", got)
+	}
+}
+
+func TestPublicMessage(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	records := []JournalRecord{
+		{Kind: RecordExecution, Execution: &ExecutionReport{OrderState: OrderState{OrderId: "b-1", ClientOrderId: "c-1", AccountId: "alice"}}},
+		{Kind: RecordCommandEvent, CommandEvent: &CommandEvent{OrderId: "b-1", AccountId: "alice"}},
+	}
+	for _, rec := range records {
+		tag, relog := outputMessage(pair, rec)
+		public := publicMessage(relog)
+		if public["OrderId"] != "b-1" || public["AccountId"] != nil || public["ClientOrderId"] != nil {
+			t.Errorf("%s: websocket gets %v", tag, public)
+		}
+		if relog["AccountId"] != "alice" {
+			t.Errorf("%s: output queue gets %v", tag, relog)
+		}
+	}
+}
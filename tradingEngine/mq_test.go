@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPlaceOrderReply(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		ok     bool
+		reason string
+	}{
+		{
+			name: "resting post-only",
+			body: `{"command":"new_order","order_id":"b-1","order_type":"bid","price":"99","quantity":"1","post_only":true,"account_id":"buyer"}`,
+			ok:   true,
+		},
+		{
+			name:   "post-only that would take",
+			body:   `{"command":"new_order","order_id":"b-1","order_type":"bid","price":"100","quantity":"1","post_only":true,"account_id":"buyer"}`,
+			reason: RejectReasonPostOnly,
+		},
+		{
+			name:   "price off the tick",
+			body:   `{"command":"new_order","order_id":"b-1","order_type":"bid","price":"100.001","quantity":"1","account_id":"buyer"}`,
+			reason: RejectReasonTickSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := testPair(t, TradingRules{})
+			limit(pair, "a-1", "100", "1")
+
+			var param orderArgs
+			if err := json.Unmarshal([]byte(tt.body), &param); err != nil {
+				t.Fatal(err)
+			}
+			got := placeOrder(pair, &param)
+			if got.Ok != tt.ok || got.Reason != tt.reason || got.OrderId != "b-1" {
+				t.Errorf("got %+v, want ok %v reason %q", got, tt.ok, tt.reason)
+			}
+		})
+	}
+}
+
+func TestOutputQueueDrops(t *testing.T) {
+	// Nothing publishes, as when the broker is down
+	q := &outputQueue{symbol: "test", pending: make(chan string, 2)}
+	for i := 0; i < 5; i++ {
+		q.Push("result")
+	}
+	if len(q.pending) != 2 || q.dropped != 3 {
+		t.Errorf("%d waiting and %d dropped, want 2 and 3", len(q.pending), q.dropped)
+	}
+}
@@ -1,45 +1,122 @@
 package main
 
-import (
-	"github.com/shopspring/decimal"
-)
-
+// Order prices are held in ticks of the pair's price digit, quantities in lots
+// of its quantity digit and quote amounts in ticks times lots.
 type Order struct {
 	orderId    string
-	price      decimal.Decimal
-	quantity   decimal.Decimal
+	price      int64
+	quantity   int64
 	createTime int64
-	index      int
+	sequence   int64
 
 	priceType PriceType
-	amount    decimal.Decimal
+	amount    int64
+
+	timeInForce TimeInForce
+	expireTime  int64
+
+	postOnly     bool
+	postOnlyMode PostOnlyMode
+
+	stopPrice int64
+
+	// iceberg orders only show displayQty at a time, the rest is hidden
+	displayQty int64
+	hiddenQty  int64
+
+	accountId string
+	stpMode   STPMode
+
+	// chosen by the client, unique per account
+	clientOrderId string
 }
 
-func (o *Order) GetIndex() int {
-	return o.index
+func (o *Order) GetSequence() int64 {
+	return o.sequence
 }
 
-func (o *Order) SetIndex(index int) {
-	o.index = index
+func (o *Order) SetSequence(sequence int64) {
+	o.sequence = sequence
 }
 
-func (o *Order) SetQuantity(qnt decimal.Decimal) {
+func (o *Order) SetQuantity(qnt int64) {
 	o.quantity = qnt
 }
 
-func (o *Order) SetAmount(amount decimal.Decimal) {
+func (o *Order) SetAmount(amount int64) {
 	o.amount = amount
 }
 
+func (o *Order) SetPrice(price int64) {
+	o.price = price
+}
+
+func (o *Order) SetPriceType(pt PriceType) {
+	o.priceType = pt
+}
+
+func (o *Order) SetStopPrice(stopPrice int64) {
+	o.stopPrice = stopPrice
+}
+
+func (o *Order) SetDisplayQuantity(displayQty int64) {
+	o.displayQty = displayQty
+}
+
+func (o *Order) SetHiddenQuantity(hiddenQty int64) {
+	o.hiddenQty = hiddenQty
+}
+
+// Hide moves everything above the display quantity of an iceberg order into the
+// hidden reserve.
+func (o *Order) Hide() {
+	if o.displayQty <= 0 || o.quantity <= o.displayQty {
+		return
+	}
+	o.hiddenQty += o.quantity - o.displayQty
+	o.quantity = o.displayQty
+}
+
+// Replenish refills the visible slice of an iceberg order from its hidden
+// reserve, reporting whether anything was left to show.
+func (o *Order) Replenish() bool {
+	if o.hiddenQty <= 0 {
+		return false
+	}
+	slice := min64(o.displayQty, o.hiddenQty)
+	o.hiddenQty -= slice
+	o.quantity += slice
+	return true
+}
+
+func (o *Order) SetAccount(accountId string, stpMode STPMode) {
+	o.accountId = accountId
+	o.stpMode = stpMode
+}
+
+func (o *Order) SetClientOrderId(clientOrderId string) {
+	o.clientOrderId = clientOrderId
+}
+
+func (o *Order) SetPostOnly(postOnly bool, mode PostOnlyMode) {
+	o.postOnly = postOnly
+	o.postOnlyMode = mode
+}
+
+func (o *Order) SetTimeInForce(tif TimeInForce, expireTime int64) {
+	o.timeInForce = tif
+	o.expireTime = expireTime
+}
+
 func (o *Order) GetUniqueId() string {
 	return o.orderId
 }
 
-func (o *Order) GetPrice() decimal.Decimal {
+func (o *Order) GetPrice() int64 {
 	return o.price
 }
 
-func (o *Order) GetQuantity() decimal.Decimal {
+func (o *Order) GetQuantity() int64 {
 	return o.quantity
 }
 
@@ -50,10 +127,50 @@ func (o *Order) GetCreateTime() int64 {
 func (o *Order) GetPriceType() PriceType {
 	return o.priceType
 }
-func (o *Order) GetAmount() decimal.Decimal {
+func (o *Order) GetAmount() int64 {
 	return o.amount
 }
 
+func (o *Order) GetTimeInForce() TimeInForce {
+	return o.timeInForce
+}
+
+func (o *Order) GetExpireTime() int64 {
+	return o.expireTime
+}
+
+func (o *Order) GetStopPrice() int64 {
+	return o.stopPrice
+}
+
+func (o *Order) GetDisplayQuantity() int64 {
+	return o.displayQty
+}
+
+func (o *Order) GetHiddenQuantity() int64 {
+	return o.hiddenQty
+}
+
+func (o *Order) GetAccountId() string {
+	return o.accountId
+}
+
+func (o *Order) GetClientOrderId() string {
+	return o.clientOrderId
+}
+
+func (o *Order) GetSTPMode() STPMode {
+	return o.stpMode
+}
+
+func (o *Order) IsPostOnly() bool {
+	return o.postOnly
+}
+
+func (o *Order) GetPostOnlyMode() PostOnlyMode {
+	return o.postOnlyMode
+}
+
 type AskItem struct {
 	Order
 }
@@ -61,6 +178,7 @@ type AskItem struct {
 type BidItem struct {
 	Order
 }
+
 func (a *AskItem) GetOrderSide() OrderSide {
 	return OrderSideSell
 }
@@ -70,14 +188,14 @@ func (b *BidItem) GetOrderSide() OrderSide {
 }
 
 func (a *AskItem) Less(b HeapItem) bool {
-	return (a.price.Cmp(b.(*AskItem).price) == -1) || (a.price.Cmp(b.(*AskItem).price) == 0 && a.createTime < b.(*AskItem).createTime)
+	return a.price < b.(*AskItem).price || (a.price == b.(*AskItem).price && a.sequence < b.(*AskItem).sequence)
 }
 
 func (a *BidItem) Less(b HeapItem) bool {
-	return (a.price.Cmp(b.(*BidItem).price) == 1) || (a.price.Cmp(b.(*BidItem).price) == 0 && a.createTime < b.(*BidItem).createTime)
+	return a.price > b.(*BidItem).price || (a.price == b.(*BidItem).price && a.sequence < b.(*BidItem).sequence)
 }
 
-func NewAskItem(pt PriceType, uniqId string, price, quantity, amount decimal.Decimal, createTime int64) *AskItem {
+func NewAskItem(pt PriceType, uniqId string, price, quantity, amount int64, createTime int64) *AskItem {
 	return &AskItem{
 		Order: Order{
 			orderId:    uniqId,
@@ -90,7 +208,7 @@ func NewAskItem(pt PriceType, uniqId string, price, quantity, amount decimal.Dec
 	}
 }
 
-func NewBidItem(pt PriceType, uniqId string, price, quantity, amount decimal.Decimal, createTime int64) *BidItem {
+func NewBidItem(pt PriceType, uniqId string, price, quantity, amount int64, createTime int64) *BidItem {
 	return &BidItem{
 		Order: Order{
 			orderId:    uniqId,
@@ -1,20 +1,60 @@
 package main
 
 import (
-	"container/heap"
+	"container/list"
 	"sync"
+
+	"github.com/emirpasic/gods/trees/redblacktree"
+	"github.com/emirpasic/gods/utils"
 )
 
+// PriceLevel holds the resting orders at one price in arrival order, together
+// with their total visible quantity.
+type PriceLevel struct {
+	Price    int64
+	Quantity int64
+	orders   *list.List
+}
+
+// bookEntry is what the book knows about a resting order: where it sits and
+// how much of its quantity is counted in its level.
+type bookEntry struct {
+	item     HeapItem
+	level    *PriceLevel
+	elem     *list.Element
+	quantity int64
+}
+
+// Orderbook keeps one side of the book as price levels sorted best first.
+// The best level is cached, so reading the top of the book is O(1) and depth
+// only walks as many levels as are asked for.
 type Orderbook struct {
-	h *ExtendedHeap
-	m map[string]*HeapItem
+	levels *redblacktree.Tree
+	best   *PriceLevel
+	m      map[string]*bookEntry
 	sync.Mutex
 
-	depth [][2]string
+	// time priority handed out to orders entering the book
+	seq int64
+}
+
+func NewOrderBook(side OrderSide) *Orderbook {
+	comparator := utils.Int64Comparator
+	// Bids are sorted highest price first
+	if side == OrderSideBuy {
+		comparator = func(a, b interface{}) int {
+			return utils.Int64Comparator(b, a)
+		}
+	}
+
+	return &Orderbook{
+		levels: redblacktree.NewWith(comparator),
+		m:      make(map[string]*bookEntry),
+	}
 }
 
 func (o *Orderbook) Len() int {
-	return o.h.Len()
+	return len(o.m)
 }
 
 func (o *Orderbook) Push(item HeapItem) (exist bool) {
@@ -26,44 +66,177 @@ func (o *Orderbook) Push(item HeapItem) (exist bool) {
 		return true
 	}
 
-	heap.Push(o.h, item)
-	o.m[id] = &item
+	o.seq++
+	item.SetSequence(o.seq)
+	o.insert(item, false)
 	return false
 }
 
-func (o *Orderbook) Get(index int) HeapItem {
-	n := o.h.Len()
-	if n <= index {
-		return nil
+// Restore puts an order back on the book with the priority it had before.
+func (o *Orderbook) Restore(item HeapItem) {
+	o.Lock()
+	defer o.Unlock()
+
+	if item.GetSequence() > o.seq {
+		o.seq = item.GetSequence()
 	}
+	o.insert(item, true)
+}
+
+// insert queues the item at its price level, behind every order at that
+// price unless byPriority asks for it to be placed by its sequence instead.
+func (o *Orderbook) insert(item HeapItem, byPriority bool) {
+	level := o.level(item.GetPrice())
 
-	return (*o.h)[index]
+	var elem *list.Element
+	if byPriority {
+		for e := level.orders.Back(); e != nil; e = e.Prev() {
+			if e.Value.(*bookEntry).item.Less(item) {
+				elem = e
+				break
+			}
+		}
+	}
+
+	entry := &bookEntry{item: item, level: level, quantity: item.GetQuantity()}
+	if elem != nil {
+		entry.elem = level.orders.InsertAfter(entry, elem)
+	} else if byPriority {
+		entry.elem = level.orders.PushFront(entry)
+	} else {
+		entry.elem = level.orders.PushBack(entry)
+	}
+	level.Quantity += entry.quantity
+	o.m[item.GetUniqueId()] = entry
+}
+
+// level returns the level at the price, creating it when needed.
+func (o *Orderbook) level(price int64) *PriceLevel {
+	if found, ok := o.levels.Get(price); ok {
+		return found.(*PriceLevel)
+	}
+
+	level := &PriceLevel{
+		Price:  price,
+		orders: list.New(),
+	}
+	o.levels.Put(price, level)
+	if o.best == nil || o.levels.Comparator(price, o.best.Price) < 0 {
+		o.best = level
+	}
+	return level
+}
+
+// unlink takes the entry out of its level, dropping the level once empty.
+func (o *Orderbook) unlink(entry *bookEntry) {
+	level := entry.level
+	level.orders.Remove(entry.elem)
+	level.Quantity -= entry.quantity
+
+	if level.orders.Len() > 0 {
+		return
+	}
+	o.levels.Remove(level.Price)
+	if o.best == level {
+		o.best = nil
+		if left := o.levels.Left(); left != nil {
+			o.best = left.Value.(*PriceLevel)
+		}
+	}
+}
+
+// Update brings the level total in line with the order's visible quantity
+// after it has been changed in place. The order keeps its priority.
+func (o *Orderbook) Update(item HeapItem) {
+	o.Lock()
+	defer o.Unlock()
+
+	entry, ok := o.m[item.GetUniqueId()]
+	if !ok {
+		return
+	}
+	entry.level.Quantity += item.GetQuantity() - entry.quantity
+	entry.quantity = item.GetQuantity()
+}
+
+// Requeue puts a resting order behind every other order at its price by
+// handing it a fresh sequence. It also moves the order to another level when
+// its price has changed.
+func (o *Orderbook) Requeue(item HeapItem) {
+	o.Lock()
+	defer o.Unlock()
+
+	entry, ok := o.m[item.GetUniqueId()]
+	if !ok {
+		return
+	}
+	o.unlink(entry)
+
+	o.seq++
+	item.SetSequence(o.seq)
+	o.insert(item, false)
+}
+
+// Find looks a resting order up by id through the book index.
+func (o *Orderbook) Find(uniqId string) HeapItem {
+	o.Lock()
+	defer o.Unlock()
+
+	entry, ok := o.m[uniqId]
+	if !ok {
+		return nil
+	}
+	return entry.item
 }
 
 func (o *Orderbook) Root() HeapItem {
-	return o.Get(0)
+	if o.best == nil {
+		return nil
+	}
+	return o.best.orders.Front().Value.(*bookEntry).item
 }
 
 func (o *Orderbook) Remove(uniqId string) HeapItem {
 	o.Lock()
 	defer o.Unlock()
 
-	old, ok := o.m[uniqId]
+	entry, ok := o.m[uniqId]
 	if !ok {
 		return nil
 	}
 
-	item := heap.Remove(o.h, (*old).GetIndex())
+	o.unlink(entry)
 	delete(o.m, uniqId)
-	return item.(HeapItem)
+	return entry.item
+}
+
+// Walk visits the resting orders in priority order until fn returns false.
+func (o *Orderbook) Walk(fn func(item HeapItem) bool) {
+	it := o.levels.Iterator()
+	for it.Next() {
+		for e := it.Value().(*PriceLevel).orders.Front(); e != nil; e = e.Next() {
+			if !fn(e.Value.(*bookEntry).item) {
+				return
+			}
+		}
+	}
 }
 
-func (o *Orderbook) clean() {
+// Levels returns up to size levels from the best price outwards, all of them
+// when size is not positive.
+func (o *Orderbook) Levels(size int) []*PriceLevel {
 	o.Lock()
 	defer o.Unlock()
 
-	h := make(ExtendedHeap, 0)
-	heap.Init(&h)
-	o.h = &h
-	o.m = make(map[string]*HeapItem)
+	if size <= 0 || size > o.levels.Size() {
+		size = o.levels.Size()
+	}
+
+	res := make([]*PriceLevel, 0, size)
+	it := o.levels.Iterator()
+	for len(res) < size && it.Next() {
+		level := it.Value().(*PriceLevel)
+		res = append(res, &PriceLevel{Price: level.Price, Quantity: level.Quantity})
+	}
+	return res
 }
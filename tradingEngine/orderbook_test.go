@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+const restingOrders = 100000
+
+// restingBook fills one side of a book with orders spread over 1000 prices.
+func restingBook(b *testing.B) *Orderbook {
+	ob := NewOrderBook(OrderSideSell)
+	for i := 0; i < restingOrders; i++ {
+		ob.Push(NewAskItem(PriceTypeLimit, fmt.Sprintf("a-%d", i), int64(10000+i%1000), 1, 0, int64(i)))
+	}
+	b.ResetTimer()
+	return ob
+}
+
+func BenchmarkDepth(b *testing.B) {
+	ob := restingBook(b)
+	for i := 0; i < b.N; i++ {
+		ob.Levels(20)
+	}
+}
+
+// BenchmarkDepthFullScan builds the same depth by visiting every order and
+// sorting the prices, which is what the heap book had to do.
+func BenchmarkDepthFullScan(b *testing.B) {
+	ob := restingBook(b)
+	for i := 0; i < b.N; i++ {
+		levels := map[int64]int64{}
+		ob.Walk(func(item HeapItem) bool {
+			levels[item.GetPrice()] += item.GetQuantity()
+			return true
+		})
+		prices := make([]int64, 0, len(levels))
+		for price := range levels {
+			prices = append(prices, price)
+		}
+		sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+		_ = prices[:20]
+	}
+}
+
+func BenchmarkBest(b *testing.B) {
+	ob := restingBook(b)
+	for i := 0; i < b.N; i++ {
+		ob.Root()
+	}
+}
+
+func BenchmarkPushRemove(b *testing.B) {
+	ob := restingBook(b)
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("x-%d", i)
+		ob.Push(NewAskItem(PriceTypeLimit, id, int64(10000+i%1000), 1, 0, int64(i)))
+		ob.Remove(id)
+	}
+}
+
+func TestOrderbookLevels(t *testing.T) {
+	ob := NewOrderBook(OrderSideBuy)
+	orders := []struct {
+		id    string
+		price int64
+		qty   int64
+	}{
+		{"b-1", 100, 1},
+		{"b-2", 102, 2},
+		{"b-3", 100, 3},
+		{"b-4", 101, 4},
+	}
+	for _, o := range orders {
+		ob.Push(NewBidItem(PriceTypeLimit, o.id, o.price, o.qty, 0, 0))
+	}
+	ob.Remove("b-4")
+
+	tests := []struct {
+		size int
+		want []PriceLevel
+	}{
+		{0, []PriceLevel{{Price: 102, Quantity: 2}, {Price: 100, Quantity: 4}}},
+		{1, []PriceLevel{{Price: 102, Quantity: 2}}},
+		{5, []PriceLevel{{Price: 102, Quantity: 2}, {Price: 100, Quantity: 4}}},
+	}
+	for _, tt := range tests {
+		got := ob.Levels(tt.size)
+		if len(got) != len(tt.want) {
+			t.Fatalf("size %d: got %d levels, want %d", tt.size, len(got), len(tt.want))
+		}
+		for i := range got {
+			if got[i].Price != tt.want[i].Price || got[i].Quantity != tt.want[i].Quantity {
+				t.Errorf("size %d level %d: got %d@%d, want %d@%d", tt.size, i,
+					got[i].Quantity, got[i].Price, tt.want[i].Quantity, tt.want[i].Price)
+			}
+		}
+	}
+	if root := ob.Root().GetUniqueId(); root != "b-2" {
+		t.Errorf("best bid %s, want b-2", root)
+	}
+}
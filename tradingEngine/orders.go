@@ -0,0 +1,368 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	orderHistory      = flag.Int("order-history", 10000, "how many closed orders each pair keeps for status queries")
+	clientIdRetention = flag.Duration("client-id-retention", 24*time.Hour, "how long a client order id stays taken after its order")
+)
+
+const (
+	OrderStatusNew             = "new"
+	OrderStatusPartiallyFilled = "partially_filled"
+	OrderStatusFilled          = "filled"
+	OrderStatusCancelled       = "cancelled"
+	OrderStatusRejected        = "rejected"
+	OrderStatusExpired         = "expired"
+
+	ExecTypeNew      = "new"
+	ExecTypeTrade    = "trade"
+	ExecTypeCancel   = "cancelled"
+	ExecTypeReject   = "rejected"
+	ExecTypeExpire   = "expired"
+	ExecTypeReplaced = "replaced"
+)
+
+// OrderState is what became of an order so far. Quantity is the whole size
+// of the order, or zero for a market buy sized by Amount.
+type OrderState struct {
+	Symbol         string          `json:"symbol"`
+	OrderId        string          `json:"order_id"`
+	ClientOrderId  string          `json:"client_order_id,omitempty"`
+	AccountId      string          `json:"account_id"`
+	Side           string          `json:"side"`
+	PriceType      string          `json:"price_type"`
+	Price          decimal.Decimal `json:"price"`
+	Quantity       decimal.Decimal `json:"quantity"`
+	Amount         decimal.Decimal `json:"amount"`
+	Status         string          `json:"status"`
+	Reason         string          `json:"reason,omitempty"`
+	FilledQuantity decimal.Decimal `json:"filled_quantity"`
+	FilledAmount   decimal.Decimal `json:"filled_amount"`
+	AveragePrice   decimal.Decimal `json:"average_price"`
+	CreateTime     int64           `json:"create_time"`
+	UpdateTime     int64           `json:"update_time"`
+}
+
+// ExecutionReport tells the owner of an order what just happened to it.
+type ExecutionReport struct {
+	OrderState
+	ExecType     string          `json:"exec_type"`
+	LastQuantity decimal.Decimal `json:"last_quantity"`
+	LastPrice    decimal.Decimal `json:"last_price"`
+	Fee          decimal.Decimal `json:"fee"`
+	FeeAsset     string          `json:"fee_asset,omitempty"`
+	Sequence     int64           `json:"sequence"`
+}
+
+type orderState struct {
+	id        string
+	clientId  string
+	account   string
+	side      OrderSide
+	priceType PriceType
+	price     int64
+	quantity  int64
+	amount    int64
+	status    string
+	reason    string
+	filled    int64
+	// ticks x lots traded so far
+	filledAmount int64
+	createTime   int64
+	updateTime   int64
+}
+
+func (s *orderState) live() bool {
+	return s.status == OrderStatusNew || s.status == OrderStatusPartiallyFilled
+}
+
+// Order looks up an order that is open or was closed recently, by its id or
+// by the client order id its account gave it.
+func (t *TradePair) Order(uniq, accountId string) (OrderState, bool) {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	s, ok := t.orders[t.resolveOrderId(uniq, accountId, uniq)]
+	if !ok {
+		return OrderState{}, false
+	}
+	return t.orderView(s), true
+}
+
+func (t *TradePair) orderView(s *orderState) OrderState {
+	view := OrderState{
+		Symbol:         t.Symbol,
+		OrderId:        s.id,
+		ClientOrderId:  s.clientId,
+		AccountId:      s.account,
+		Side:           OrderSide2String(s.side),
+		PriceType:      PriceType2String(s.priceType),
+		Price:          t.TicksToPrice(s.price),
+		Quantity:       t.LotsToQty(s.quantity),
+		Amount:         t.UnitsToAmount(s.amount),
+		Status:         s.status,
+		Reason:         s.reason,
+		FilledQuantity: t.LotsToQty(s.filled),
+		FilledAmount:   t.UnitsToAmount(s.filledAmount),
+		CreateTime:     s.createTime,
+		UpdateTime:     s.updateTime,
+	}
+	if s.filled > 0 {
+		view.AveragePrice = view.FilledAmount.DivRound(view.FilledQuantity, int32(t.priceDigit+t.quantityDigit))
+	}
+	return view
+}
+
+// stateRecord turns the view of an order back into its state.
+func (t *TradePair) stateRecord(v OrderState) *orderState {
+	side := OrderSideBuy
+	if v.Side == OrderSide2String(OrderSideSell) {
+		side = OrderSideSell
+	}
+	return &orderState{
+		id:           v.OrderId,
+		clientId:     v.ClientOrderId,
+		account:      v.AccountId,
+		side:         side,
+		priceType:    string2PriceType(v.PriceType),
+		price:        t.PriceTicks(v.Price),
+		quantity:     t.QtyLots(v.Quantity),
+		amount:       t.AmountUnits(v.Amount),
+		status:       v.Status,
+		reason:       v.Reason,
+		filled:       t.QtyLots(v.FilledQuantity),
+		filledAmount: t.AmountUnits(v.FilledAmount),
+		createTime:   v.CreateTime,
+		updateTime:   v.UpdateTime,
+	}
+}
+
+// trackOrder starts the record of an order as it arrives.
+func (t *TradePair) trackOrder(item HeapItem) {
+	price := item.GetPrice()
+	if item.GetPriceType() == PriceTypeStop {
+		price = 0
+	}
+	t.pruneClientOrders()
+	t.indexClientOrder(item.GetAccountId(), item.GetClientOrderId(), item.GetUniqueId(), t.timestamp)
+	t.orders[item.GetUniqueId()] = &orderState{
+		id:         item.GetUniqueId(),
+		clientId:   item.GetClientOrderId(),
+		account:    item.GetAccountId(),
+		side:       item.GetOrderSide(),
+		priceType:  item.GetPriceType(),
+		price:      price,
+		quantity:   item.GetQuantity() + item.GetHiddenQuantity(),
+		amount:     item.GetAmount(),
+		status:     OrderStatusNew,
+		createTime: item.GetCreateTime(),
+		updateTime: t.timestamp,
+	}
+}
+
+func (t *TradePair) orderAccepted(uniq string) {
+	if s, ok := t.orders[uniq]; ok {
+		t.sendExecutionReport(s, ExecutionReport{ExecType: ExecTypeNew})
+	}
+}
+
+func (t *TradePair) orderRejected(uniq, reason string) {
+	s, ok := t.orders[uniq]
+	if !ok || !s.live() {
+		return
+	}
+	s.reason = reason
+	t.closeOrder(s, OrderStatusRejected)
+	t.sendExecutionReport(s, ExecutionReport{ExecType: ExecTypeReject})
+}
+
+func (t *TradePair) orderCancelled(uniq, reason string) {
+	s, ok := t.orders[uniq]
+	if !ok || !s.live() {
+		return
+	}
+	s.reason = reason
+	if reason == CancelReasonExpired {
+		t.closeOrder(s, OrderStatusExpired)
+		t.sendExecutionReport(s, ExecutionReport{ExecType: ExecTypeExpire})
+		return
+	}
+	t.closeOrder(s, OrderStatusCancelled)
+	t.sendExecutionReport(s, ExecutionReport{ExecType: ExecTypeCancel})
+}
+
+// orderFilled adds a fill to an order. It is filled once nothing of it is
+// left to trade.
+func (t *TradePair) orderFilled(item HeapItem, price, quantity, fee int64, feeAsset string) {
+	s, ok := t.orders[item.GetUniqueId()]
+	if !ok {
+		return
+	}
+	s.filled += quantity
+	// bounded like the balances, see settleFunds
+	s.filledAmount += price * quantity
+	s.updateTime = t.timestamp
+	s.status = OrderStatusPartiallyFilled
+
+	done := item.GetQuantity()+item.GetHiddenQuantity() == 0
+	if byAmount(item) {
+		done = item.GetAmount() == 0
+	}
+	if done {
+		t.closeOrder(s, OrderStatusFilled)
+	}
+	t.sendExecutionReport(s, ExecutionReport{
+		ExecType:     ExecTypeTrade,
+		LastQuantity: t.LotsToQty(quantity),
+		LastPrice:    t.TicksToPrice(price),
+		Fee:          t.assetToDecimal(feeAsset, fee),
+		FeeAsset:     feeAsset,
+	})
+}
+
+// orderReplaced picks up the new price and size of an open order.
+func (t *TradePair) orderReplaced(uniq string, report bool) {
+	s, ok := t.orders[uniq]
+	item := t.openOrder(uniq)
+	if !ok || item == nil {
+		return
+	}
+	s.price = item.GetPrice()
+	s.quantity = s.filled + item.GetQuantity() + item.GetHiddenQuantity()
+	s.updateTime = t.timestamp
+	if report {
+		t.sendExecutionReport(s, ExecutionReport{ExecType: ExecTypeReplaced})
+	}
+}
+
+func (t *TradePair) orderRepriced(uniq string, price int64) {
+	if s, ok := t.orders[uniq]; ok {
+		s.price = price
+	}
+}
+
+// closeOrder moves an order into the history, which keeps the most recently
+// closed ones. Its client order id stays taken for the retention window
+// whether the order is still in the history or not.
+func (t *TradePair) closeOrder(s *orderState, status string) {
+	s.status = status
+	s.updateTime = t.timestamp
+
+	// An order open for longer than the window frees its client id now
+	key := clientOrderKey(s.account, s.clientId)
+	if c, ok := t.clientOrders[key]; ok && c.id == s.id && t.clientOrderExpired(c.time) {
+		delete(t.clientOrders, key)
+	}
+
+	t.closed = append(t.closed, s.id)
+	for len(t.closed) > *orderHistory {
+		delete(t.orders, t.closed[0])
+		t.closed = t.closed[1:]
+	}
+}
+
+// clientOrder is the order an account gave a client order id to, and when.
+type clientOrder struct {
+	id   string
+	time int64
+}
+
+// ClientOrderRecord is a client order id in a snapshot.
+type ClientOrderRecord struct {
+	AccountId     string `json:"account_id"`
+	ClientOrderId string `json:"client_order_id"`
+	OrderId       string `json:"order_id"`
+	Time          int64  `json:"time"`
+}
+
+func clientOrderKey(accountId, clientId string) string {
+	return accountId + "/" + clientId
+}
+
+func (t *TradePair) clientOrderExpired(ts int64) bool {
+	return t.timestamp-ts >= int64(*clientIdRetention)
+}
+
+// indexClientOrder points the client order id at uniq, unless an open order
+// still holds it.
+func (t *TradePair) indexClientOrder(accountId, clientId, uniq string, ts int64) {
+	if clientId == "" {
+		return
+	}
+	key := clientOrderKey(accountId, clientId)
+	if c, ok := t.clientOrders[key]; ok {
+		if s, ok := t.orders[c.id]; ok && s.live() {
+			return
+		}
+	}
+	t.clientOrders[key] = clientOrder{id: uniq, time: ts}
+	t.clientIds = append(t.clientIds, ClientOrderRecord{AccountId: accountId, ClientOrderId: clientId, OrderId: uniq, Time: ts})
+}
+
+// pruneClientOrders frees the client order ids given longer ago than the
+// retention window. One held by an open order is freed when it closes.
+func (t *TradePair) pruneClientOrders() {
+	for len(t.clientIds) > 0 && t.clientOrderExpired(t.clientIds[0].Time) {
+		r := t.clientIds[0]
+		t.clientIds = t.clientIds[1:]
+
+		key := clientOrderKey(r.AccountId, r.ClientOrderId)
+		c, ok := t.clientOrders[key]
+		if !ok || c.id != r.OrderId {
+			continue
+		}
+		if s, ok := t.orders[c.id]; ok && s.live() {
+			continue
+		}
+		delete(t.clientOrders, key)
+	}
+}
+
+// clientOrderTaken reports whether the account already used clientId for an
+// order that is still open, or that arrived within the retention window.
+func (t *TradePair) clientOrderTaken(accountId, clientId string) bool {
+	if clientId == "" {
+		return false
+	}
+	c, ok := t.clientOrders[clientOrderKey(accountId, clientId)]
+	if !ok {
+		return false
+	}
+	if s, ok := t.orders[c.id]; ok && s.live() {
+		return true
+	}
+	return !t.clientOrderExpired(c.time)
+}
+
+// resolveOrderId is uniq, or when the account gave clientId to an order, the
+// id of that order.
+func (t *TradePair) resolveOrderId(uniq, accountId, clientId string) string {
+	if _, ok := t.orders[uniq]; ok || accountId == "" {
+		return uniq
+	}
+	if c, ok := t.clientOrders[clientOrderKey(accountId, clientId)]; ok {
+		return c.id
+	}
+	return uniq
+}
+
+func (t *TradePair) sendExecutionReport(s *orderState, report ExecutionReport) {
+	if t.replaying {
+		return
+	}
+
+	report.OrderState = t.orderView(s)
+	report.Sequence = t.sequence
+
+	if Debug {
+		logrus.Infof("%s execution report: %+v", t.Symbol, report)
+	}
+	t.output(JournalRecord{Kind: RecordExecution, Sequence: t.sequence, Execution: &report})
+}
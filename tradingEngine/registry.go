@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PairConfig describes one instrument hosted by the engine.
+type PairConfig struct {
+	Symbol        string       `json:"symbol"`
+	PriceDigit    int          `json:"price_digit"`
+	QuantityDigit int          `json:"quantity_digit"`
+	Rules         TradingRules `json:"rules"`
+}
+
+// symbols end up in routing keys and file names
+var symbolPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// names taken by routes under /api
+var reservedSymbols = map[string]bool{"pairs": true, "orders": true}
+
+func validSymbol(symbol string) bool {
+	return symbolPattern.MatchString(symbol) && !reservedSymbols[symbol]
+}
+
+// Registry holds every TradePair of the process, keyed by symbol.
+type Registry struct {
+	sync.RWMutex
+	pairs   map[string]*TradePair
+	configs map[string]PairConfig
+
+	// pairs created at runtime, kept in the data dir across restarts
+	created []PairConfig
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		pairs:   make(map[string]*TradePair),
+		configs: make(map[string]PairConfig),
+	}
+}
+
+// Add opens the pair described by cfg and starts serving it.
+func (r *Registry) Add(cfg PairConfig) (*TradePair, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.add(cfg)
+}
+
+// Create adds a pair at runtime and records it, so it is opened again on
+// the next start.
+func (r *Registry) Create(cfg PairConfig) (*TradePair, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	t, err := r.add(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.created = append(r.created, cfg)
+	if err := r.saveCreated(); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func (r *Registry) add(cfg PairConfig) (*TradePair, error) {
+	if !validSymbol(cfg.Symbol) {
+		return nil, fmt.Errorf("invalid pair symbol %q", cfg.Symbol)
+	}
+	if _, ok := r.pairs[cfg.Symbol]; ok {
+		return nil, fmt.Errorf("pair %s is already registered", cfg.Symbol)
+	}
+	t, err := NewTradePair(cfg.Symbol, cfg.PriceDigit, cfg.QuantityDigit, cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("pair %s: %s", cfg.Symbol, err)
+	}
+	r.pairs[cfg.Symbol] = t
+	r.configs[cfg.Symbol] = cfg
+	return t, nil
+}
+
+func (r *Registry) Config(symbol string) PairConfig {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.configs[symbol]
+}
+
+func createdPairsPath() string {
+	return filepath.Join(*dataDir, "pairs.json")
+}
+
+// LoadCreated opens the pairs created at runtime before the last restart.
+// Symbols already configured from the environment are skipped.
+func (r *Registry) LoadCreated() error {
+	if *dataDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(createdPairsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	configs := []PairConfig{}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("%s: %s", createdPairsPath(), err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, cfg := range configs {
+		r.created = append(r.created, cfg)
+		if _, ok := r.pairs[cfg.Symbol]; ok {
+			continue
+		}
+		if _, err := r.add(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) saveCreated() error {
+	if *dataDir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(r.created, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := createdPairsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, createdPairsPath())
+}
+
+func (r *Registry) Get(symbol string) (*TradePair, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	t, ok := r.pairs[symbol]
+	return t, ok
+}
+
+// All returns the pairs sorted by symbol.
+func (r *Registry) All() []*TradePair {
+	r.RLock()
+	defer r.RUnlock()
+
+	res := make([]*TradePair, 0, len(r.pairs))
+	for _, t := range r.pairs {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Symbol < res[j].Symbol
+	})
+	return res
+}
+
+// Shutdown snapshots and closes every pair.
+func (r *Registry) Shutdown() {
+	for _, t := range r.All() {
+		t.Shutdown()
+	}
+}
+
+// PairConfigsFromEnv reads the comma separated symbols in pairs. The digits
+// and trading rules are shared by every pair, and can be overridden for one
+// pair by prefixing the variable with its symbol, e.g. ethusdt_priceDigit.
+func PairConfigsFromEnv() ([]PairConfig, error) {
+	symbols := os.Getenv("pairs")
+	if symbols == "" {
+		symbols = "tradingservices"
+	}
+
+	configs := []PairConfig{}
+	for _, symbol := range strings.Split(symbols, ",") {
+		symbol = strings.TrimSpace(symbol)
+		if symbol == "" {
+			continue
+		}
+		if !validSymbol(symbol) {
+			return nil, fmt.Errorf("invalid pair symbol %q in pairs", symbol)
+		}
+
+		cfg := PairConfig{Symbol: symbol, PriceDigit: 2, QuantityDigit: 4}
+		var err error
+		if cfg.PriceDigit, err = intFromEnv(symbol, "priceDigit", cfg.PriceDigit); err != nil {
+			return nil, err
+		}
+		if cfg.QuantityDigit, err = intFromEnv(symbol, "quantityDigit", cfg.QuantityDigit); err != nil {
+			return nil, err
+		}
+		if cfg.Rules, err = TradingRulesFromEnv(symbol); err != nil {
+			return nil, err
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// pairEnv looks up the variable for one pair, falling back to the shared one.
+func pairEnv(symbol, name string) (string, string) {
+	if v := os.Getenv(symbol + "_" + name); v != "" {
+		return symbol + "_" + name, v
+	}
+	return name, os.Getenv(name)
+}
+
+func intFromEnv(symbol, name string, def int) (int, error) {
+	key, v := pairEnv(symbol, name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, v)
+	}
+	return i, nil
+}
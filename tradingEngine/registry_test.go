@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestPairConfigsFromEnv(t *testing.T) {
+	tests := []struct {
+		pairs string
+		ok    bool
+	}{
+		{"btcusdt, eth_usdt", true},
+		{"btc-usdt", false},
+		{"BTCUSDT", false},
+		{"btcusdt,orders", false},
+		{"../btcusdt", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("pairs", tt.pairs)
+		_, err := PairConfigsFromEnv()
+		if (err == nil) != tt.ok {
+			t.Errorf("pairs %q: got error %v", tt.pairs, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RejectReasonInvalidNumber = "invalid_number"
+	RejectReasonInvalidPrice  = "invalid_price"
+	RejectReasonInvalidQty    = "invalid_quantity"
+	RejectReasonTickSize      = "invalid_tick_size"
+	RejectReasonLotSize       = "invalid_lot_size"
+	RejectReasonMinQuantity   = "below_min_quantity"
+	RejectReasonMaxQuantity   = "above_max_quantity"
+	RejectReasonMinNotional   = "below_min_notional"
+	RejectReasonMaxNotional   = "above_max_notional"
+
+	RejectReasonMalformed         = "malformed_order"
+	RejectReasonNoOrderId         = "missing_order_id"
+	RejectReasonDuplicateId       = "duplicate_order_id"
+	RejectReasonDuplicateClientId = "duplicate_client_order_id"
+	RejectReasonUnknownOrder      = "unknown_order"
+	RejectReasonUnknownCommand    = "unknown_command"
+)
+
+var (
+	ErrInvalidNumber = errors.New(RejectReasonInvalidNumber)
+	ErrTickSize      = errors.New(RejectReasonTickSize)
+	ErrLotSize       = errors.New(RejectReasonLotSize)
+	ErrBandAction    = errors.New("invalid band action")
+	ErrBandDuration  = errors.New("invalid band duration")
+)
+
+// TradingRules are the order constraints of an instrument. A zero tick or lot
+// size means one unit of the price or quantity digit, a zero max quantity or
+// min notional means no limit.
+//
+// The price bands are fractions, e.g. 0.05 for 5%, of the reference price
+// (static) and of the last trade price (dynamic) that trades may print
+// within; zero disables a band. A breach is rejected, or halts the pair or
+// puts it into an auction for BandDuration, e.g. "5m". Without a duration the
+// pair stays stopped until it is reopened by hand.
+type TradingRules struct {
+	TickSize    decimal.Decimal `json:"tick_size"`
+	LotSize     decimal.Decimal `json:"lot_size"`
+	MinQuantity decimal.Decimal `json:"min_quantity"`
+	MaxQuantity decimal.Decimal `json:"max_quantity"`
+	MinNotional decimal.Decimal `json:"min_notional"`
+
+	StaticBand   decimal.Decimal `json:"static_band"`
+	DynamicBand  decimal.Decimal `json:"dynamic_band"`
+	BandAction   string          `json:"band_action,omitempty"`
+	BandDuration string          `json:"band_duration,omitempty"`
+
+	// maker and taker rates by account tier, and who collects the fees
+	Fees       map[string]FeeRate `json:"fees,omitempty"`
+	FeeAccount string             `json:"fee_account,omitempty"`
+}
+
+// tradingRules holds TradingRules in the units of the book.
+type tradingRules struct {
+	tick        int64
+	lot         int64
+	minQty      int64
+	maxQty      int64
+	minNotional int64
+
+	staticBand   int64
+	dynamicBand  int64
+	bandAction   string
+	bandDuration int64
+
+	fees       map[string]feeRate
+	feeAccount string
+}
+
+// RejectResult reports an order refused before it reached the book. Its
+// sequence is 0 when the order never reached the sequencer, see RejectOrder.
+type RejectResult struct {
+	Symbol   string `json:"symbol"`
+	OrderId  string `json:"order_id"`
+	Reason   string `json:"reason"`
+	Sequence int64  `json:"sequence"`
+}
+
+// TradingRulesFromEnv reads the rules of the pair from tickSize, lotSize,
+// minQuantity, maxQuantity, minNotional, staticBand, dynamicBand, bandAction,
+// bandDuration, fees and feeAccount.
+func TradingRulesFromEnv(symbol string) (TradingRules, error) {
+	var rules TradingRules
+	fields := []struct {
+		env string
+		dst *decimal.Decimal
+	}{
+		{"tickSize", &rules.TickSize},
+		{"lotSize", &rules.LotSize},
+		{"minQuantity", &rules.MinQuantity},
+		{"maxQuantity", &rules.MaxQuantity},
+		{"minNotional", &rules.MinNotional},
+		{"staticBand", &rules.StaticBand},
+		{"dynamicBand", &rules.DynamicBand},
+	}
+	for _, f := range fields {
+		key, v := pairEnv(symbol, f.env)
+		d, err := string2decimal(v)
+		if err != nil || d.Sign() < 0 {
+			return rules, fmt.Errorf("invalid %s %q", key, v)
+		}
+		*f.dst = d
+	}
+	_, rules.BandAction = pairEnv(symbol, "bandAction")
+	_, rules.BandDuration = pairEnv(symbol, "bandDuration")
+	_, rules.FeeAccount = pairEnv(symbol, "feeAccount")
+
+	var err error
+	if rules.Fees, err = FeesFromEnv(symbol); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// setRules scales the rules to ticks and lots. Rules finer than the digits of
+// the pair cannot be enforced and are refused.
+func (t *TradePair) setRules(rules TradingRules) error {
+	var err error
+	var r tradingRules
+	if r.tick, err = scaleDecimal(rules.TickSize, t.priceDigit, ErrTickSize); err != nil {
+		return fmt.Errorf("tick size %s: %s", rules.TickSize, err)
+	}
+	if r.lot, err = scaleDecimal(rules.LotSize, t.quantityDigit, ErrLotSize); err != nil {
+		return fmt.Errorf("lot size %s: %s", rules.LotSize, err)
+	}
+	if r.minQty, err = scaleDecimal(rules.MinQuantity, t.quantityDigit, ErrLotSize); err != nil {
+		return fmt.Errorf("min quantity %s: %s", rules.MinQuantity, err)
+	}
+	if r.maxQty, err = scaleDecimal(rules.MaxQuantity, t.quantityDigit, ErrLotSize); err != nil {
+		return fmt.Errorf("max quantity %s: %s", rules.MaxQuantity, err)
+	}
+	if r.minNotional, err = scaleDecimal(rules.MinNotional, t.priceDigit+t.quantityDigit, ErrInvalidNumber); err != nil {
+		return fmt.Errorf("min notional %s: %s", rules.MinNotional, err)
+	}
+
+	if err = r.setBands(rules); err != nil {
+		return fmt.Errorf("price bands: %s", err)
+	}
+	if err = r.setFees(rules); err != nil {
+		return fmt.Errorf("fees: %s", err)
+	}
+
+	if r.tick == 0 {
+		r.tick = 1
+	}
+	if r.lot == 0 {
+		r.lot = 1
+	}
+	if r.minQty < r.lot {
+		r.minQty = r.lot
+	}
+	t.rules = r
+	return nil
+}
+
+// ParsePrice reads a price in ticks, refusing anything finer than the price digit.
+func (t *TradePair) ParsePrice(s string) (int64, error) {
+	return parseScaled(s, t.priceDigit, ErrTickSize)
+}
+
+// ParseQuantity reads a quantity in lots, refusing anything finer than the quantity digit.
+func (t *TradePair) ParseQuantity(s string) (int64, error) {
+	return parseScaled(s, t.quantityDigit, ErrLotSize)
+}
+
+// ParseAmount reads a quote amount in ticks x lots.
+func (t *TradePair) ParseAmount(s string) (int64, error) {
+	return parseScaled(s, t.priceDigit+t.quantityDigit, ErrInvalidNumber)
+}
+
+func parseScaled(s string, digit int, errPrecision error) (int64, error) {
+	d, err := string2decimal(s)
+	if err != nil {
+		return 0, ErrInvalidNumber
+	}
+	return scaleDecimal(d, digit, errPrecision)
+}
+
+// scaleDecimal turns d into whole units of 10^-digit.
+func scaleDecimal(d decimal.Decimal, digit int, errPrecision error) (int64, error) {
+	if d.Sign() < 0 {
+		return 0, ErrInvalidNumber
+	}
+	scaled := d.Shift(int32(digit))
+	if !scaled.IsInteger() {
+		return 0, errPrecision
+	}
+	if scaled.Cmp(decimal.New(1, 18)) >= 0 {
+		return 0, ErrInvalidNumber
+	}
+	return scaled.IntPart(), nil
+}
+
+// checkOrder applies the trading rules to a new order and returns the reason
+// it is refused, or an empty string.
+func (t *TradePair) checkOrder(item HeapItem) string {
+	r := t.rules
+	pt := item.GetPriceType()
+
+	if pt == PriceTypeLimit || pt == PriceTypeStopLimit {
+		if item.GetPrice() <= 0 {
+			return RejectReasonInvalidPrice
+		}
+		if item.GetPrice()%r.tick != 0 {
+			return RejectReasonTickSize
+		}
+	}
+	if pt == PriceTypeStop || pt == PriceTypeStopLimit {
+		if item.GetStopPrice() <= 0 {
+			return RejectReasonInvalidPrice
+		}
+		if item.GetStopPrice()%r.tick != 0 {
+			return RejectReasonTickSize
+		}
+	}
+
+	// A market buy sized by amount only has a notional to check
+	if byAmount(item) {
+		if item.GetAmount() <= 0 {
+			return RejectReasonInvalidQty
+		}
+		if item.GetAmount() < r.minNotional {
+			return RejectReasonMinNotional
+		}
+		return ""
+	}
+
+	price := item.GetPrice()
+	if pt == PriceTypeMarket || pt == PriceTypeStop {
+		price = t.latestPrice
+	}
+	return t.checkQuantity(price, item.GetQuantity(), item.GetDisplayQuantity())
+}
+
+// checkQuantity applies the lot, size and notional rules. A zero price skips
+// the notional check. Every order resting on the book has passed it, so the
+// value of its fills fits in an int64.
+func (t *TradePair) checkQuantity(price, quantity, displayQty int64) string {
+	r := t.rules
+	total, ok := mulInt64(price, quantity)
+	switch {
+	case quantity <= 0:
+		return RejectReasonInvalidQty
+	case quantity%r.lot != 0 || displayQty%r.lot != 0:
+		return RejectReasonLotSize
+	case quantity < r.minQty:
+		return RejectReasonMinQuantity
+	case r.maxQty > 0 && quantity > r.maxQty:
+		return RejectReasonMaxQuantity
+	case !ok:
+		return RejectReasonMaxNotional
+	case price > 0 && total < r.minNotional:
+		return RejectReasonMinNotional
+	}
+	return ""
+}
+
+// orderReject is the reason a new order is refused, or an empty string.
+func (t *TradePair) orderReject(item HeapItem) string {
+	reason := t.statusReject()
+	if reason == "" {
+		reason = t.checkOrder(item)
+	}
+	if reason == "" {
+		reason = t.fundsReject(item)
+	}
+	return reason
+}
+
+// PreTradeCheck tells whether a new order would be accepted right now,
+// without queueing it. The order is checked again once it is sequenced, as
+// the book or the balances may have moved in between.
+func (t *TradePair) PreTradeCheck(item HeapItem) string {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	return t.orderReject(item)
+}
+
+// RejectOrder reports an order that could not be read at all, or not into
+// the book's units. It never reaches the sequencer, so its results are
+// published with sequence 0.
+func (t *TradePair) RejectOrder(uniq string, reason string) {
+	t.ChOutput <- JournalRecord{Kind: RecordReject, Reject: &RejectResult{Symbol: t.Symbol, OrderId: uniq, Reason: reason}}
+	t.RejectCommand(CommandType2String(CommandNewOrder), uniq, reason)
+}
+
+// RejectCommand reports a command that was turned away before the sequencer,
+// with sequence 0.
+func (t *TradePair) RejectCommand(command, uniq, reason string) {
+	t.ChOutput <- JournalRecord{Kind: RecordCommandEvent, CommandEvent: &CommandEvent{
+		Symbol:  t.Symbol,
+		Command: command,
+		OrderId: uniq,
+		Reason:  reason,
+	}}
+}
+
+func (t *TradePair) sendRejectNotify(uniq string, reason string) {
+	t.touched[uniq] = true
+	t.orderRejected(uniq, reason)
+	t.sendRejectResult(uniq, reason)
+}
+
+// sendRejectResult publishes a reject without changing the order it names.
+func (t *TradePair) sendRejectResult(uniq string, reason string) {
+	if t.replaying {
+		return
+	}
+
+	result := RejectResult{
+		Symbol:   t.Symbol,
+		OrderId:  uniq,
+		Reason:   reason,
+		Sequence: t.sequence,
+	}
+
+	if Debug {
+		logrus.Infof("%s reject: %+v", t.Symbol, result)
+	}
+	t.output(JournalRecord{Kind: RecordReject, Sequence: t.sequence, Reject: &result})
+}
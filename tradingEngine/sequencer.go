@@ -0,0 +1,219 @@
+package main
+
+import (
+	"time"
+)
+
+type CommandType int
+
+const (
+	CommandNewOrder     CommandType = 0
+	CommandCancelOrder  CommandType = 1
+	CommandExpireOrders CommandType = 2
+	CommandAmendOrder   CommandType = 3
+
+	CommandSetAccountSTP  CommandType = 4
+	CommandSetStatus      CommandType = 5
+	CommandEndAuction     CommandType = 6
+	CommandTransfer       CommandType = 7
+	CommandSetAccountTier CommandType = 8
+
+	CommandCancelStopOrder CommandType = 9
+)
+
+// Command is anything that changes the state of a TradePair. Commands are
+// applied one at a time in the order they reach the sequencer, each one
+// stamped with the next sequence number and the time it was sequenced.
+type Command struct {
+	Type      CommandType
+	Sequence  int64
+	Timestamp int64
+
+	Order    HeapItem
+	OrderId  string
+	ClientId string
+	Amend    *AmendRequest
+
+	AccountId string
+	STPMode   STPMode
+	Tier      string
+
+	Status   PairStatus
+	Duration int64
+
+	Asset  string
+	Amount int64
+
+	result chan CommandResult
+}
+
+// CommandResult tells the submitter how its command was applied. A command
+// that was refused carries the reason.
+type CommandResult struct {
+	Sequence int64
+	Ok       bool
+	Reason   string
+}
+
+// CommandEvent is published for every command once it has been applied, so
+// a refused command is never silent. Its sequence is 0 when the command never
+// reached the sequencer, see RejectCommand.
+type CommandEvent struct {
+	Symbol    string `json:"symbol"`
+	Command   string `json:"command"`
+	OrderId   string `json:"order_id,omitempty"`
+	AccountId string `json:"account_id,omitempty"`
+	Accepted  bool   `json:"accepted"`
+	Reason    string `json:"reason,omitempty"`
+	Sequence  int64  `json:"sequence"`
+}
+
+// NewOrder queues a new order behind every command received before it and
+// waits until it has been applied.
+func (t *TradePair) NewOrder(item HeapItem) CommandResult {
+	return t.submit(Command{
+		Type:  CommandNewOrder,
+		Order: item,
+	})
+}
+
+// CancelOrder queues a cancel and waits until it has been applied. The result
+// is only ok when the order was still open.
+func (t *TradePair) CancelOrder(uniq string) CommandResult {
+	return t.submit(Command{
+		Type:    CommandCancelOrder,
+		OrderId: uniq,
+	})
+}
+
+// CancelStopOrder queues a cancel of an order still waiting for its stop
+// price. An order that has been triggered since is left alone and the result
+// is unknown_order.
+func (t *TradePair) CancelStopOrder(uniq string) CommandResult {
+	return t.submit(Command{
+		Type:    CommandCancelStopOrder,
+		OrderId: uniq,
+	})
+}
+
+// CancelClientOrder cancels the order an account sent with clientOrderId.
+func (t *TradePair) CancelClientOrder(accountId, clientOrderId string) CommandResult {
+	return t.submit(Command{
+		Type:      CommandCancelOrder,
+		AccountId: accountId,
+		ClientId:  clientOrderId,
+	})
+}
+
+func (t *TradePair) submit(cmd Command) CommandResult {
+	cmd.result = make(chan CommandResult, 1)
+	t.ChCommand <- cmd
+	return <-cmd.result
+}
+
+// sequencer is the only place where commands are applied.
+func (t *TradePair) sequencer() {
+	for cmd := range t.ChCommand {
+		t.apply(cmd)
+	}
+}
+
+func (t *TradePair) apply(cmd Command) {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	// Replayed commands keep the sequence and time they were first given
+	if cmd.Sequence == 0 {
+		cmd.Sequence = t.sequence + 1
+	}
+	if cmd.Timestamp == 0 {
+		cmd.Timestamp = time.Now().UnixNano()
+	}
+	t.sequence = cmd.Sequence
+	t.timestamp = cmd.Timestamp
+
+	// Write ahead, so a command is never applied without being journaled
+	rec := JournalRecord{
+		Kind:      RecordCommand,
+		Sequence:  cmd.Sequence,
+		Timestamp: cmd.Timestamp,
+		Type:      cmd.Type,
+		OrderId:   cmd.OrderId,
+		ClientId:  cmd.ClientId,
+		Amend:     cmd.Amend,
+		AccountId: cmd.AccountId,
+		STPMode:   cmd.STPMode,
+		Tier:      cmd.Tier,
+		Status:    cmd.Status,
+		Duration:  cmd.Duration,
+	}
+	if cmd.Order != nil {
+		rec.Order = t.orderRecord(cmd.Order)
+	}
+	if cmd.Type == CommandTransfer {
+		rec.Transfer = &TransferRecord{Asset: cmd.Asset, Amount: t.assetToDecimal(cmd.Asset, cmd.Amount)}
+	}
+	t.record(rec)
+	t.commitJournal()
+	defer t.commitJournal()
+
+	var reason string
+	switch cmd.Type {
+	case CommandNewOrder:
+		reason = t.handlerNewOrder(cmd.Order)
+	case CommandCancelOrder:
+		reason = t.handlerCancelOrder(t.resolveOrderId(cmd.OrderId, cmd.AccountId, cmd.ClientId))
+	case CommandCancelStopOrder:
+		reason = t.handlerCancelStopOrder(cmd.OrderId)
+	case CommandExpireOrders:
+		t.expireOrders(cmd.Timestamp)
+	case CommandAmendOrder:
+		reason = t.handlerAmendOrder(cmd.Amend)
+	case CommandSetAccountSTP:
+		reason = t.handlerSetAccountSTP(cmd.AccountId, cmd.STPMode)
+	case CommandSetStatus:
+		reason = t.handlerSetStatus(cmd.Status, cmd.Duration)
+	case CommandEndAuction:
+		reason = t.handlerEndAuction()
+	case CommandTransfer:
+		reason = t.handlerTransfer(cmd.AccountId, cmd.Asset, cmd.Amount)
+	case CommandSetAccountTier:
+		reason = t.handlerSetAccountTier(cmd.AccountId, cmd.Tier)
+	}
+	t.releaseHolds()
+	t.sendCommandNotify(cmd, reason)
+
+	if cmd.result != nil {
+		cmd.result <- CommandResult{
+			Sequence: cmd.Sequence,
+			Ok:       reason == "",
+			Reason:   reason,
+		}
+	}
+}
+
+func (t *TradePair) sendCommandNotify(cmd Command, reason string) {
+	if t.replaying {
+		return
+	}
+
+	event := CommandEvent{
+		Symbol:    t.Symbol,
+		Command:   CommandType2String(cmd.Type),
+		OrderId:   cmd.OrderId,
+		AccountId: cmd.AccountId,
+		Accepted:  reason == "",
+		Reason:    reason,
+		Sequence:  cmd.Sequence,
+	}
+	switch {
+	case cmd.Order != nil:
+		event.OrderId = cmd.Order.GetUniqueId()
+		event.AccountId = cmd.Order.GetAccountId()
+	case cmd.Amend != nil:
+		event.OrderId = cmd.Amend.OrderId
+	case cmd.ClientId != "":
+		event.OrderId = t.resolveOrderId(cmd.OrderId, cmd.AccountId, cmd.ClientId)
+	}
+	t.output(JournalRecord{Kind: RecordCommandEvent, Sequence: t.sequence, CommandEvent: &event})
+}
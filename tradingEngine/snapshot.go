@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	snapshotInterval = flag.Duration("snapshot-interval", 5*time.Minute, "how often a snapshot of the book is written (0s=only at shutdown)")
+	snapshotKeep     = 3
+)
+
+// Snapshot is the state of a TradePair right after the command with the given
+// sequence was applied.
+type Snapshot struct {
+	Symbol      string          `json:"symbol"`
+	Sequence    int64           `json:"sequence"`
+	Timestamp   int64           `json:"timestamp"`
+	LatestPrice decimal.Decimal `json:"latest_price"`
+	Status      PairStatus      `json:"status"`
+	AuctionEnd  int64           `json:"auction_end,omitempty"`
+
+	ReferencePrice decimal.Decimal `json:"reference_price"`
+
+	// counters the books hand out priorities from
+	AskSequence  int64 `json:"ask_sequence"`
+	BidSequence  int64 `json:"bid_sequence"`
+	StopSequence int64 `json:"stop_sequence"`
+
+	Asks     []*OrderRecord     `json:"asks"`
+	Bids     []*OrderRecord     `json:"bids"`
+	Stops    []*OrderRecord     `json:"stops"`
+	Expiries map[string]int64   `json:"expiries"`
+	STPModes map[string]STPMode `json:"stp_modes"`
+
+	Accounts map[string]BalanceRecord `json:"accounts"`
+	Tiers    map[string]string        `json:"tiers"`
+	Holds    map[string]HoldRecord    `json:"holds"`
+
+	// open orders, then the closed ones kept for status queries, oldest first
+	Orders []OrderState `json:"orders"`
+	// client order ids still taken, oldest first
+	ClientOrders []ClientOrderRecord `json:"client_orders"`
+}
+
+// snapshot captures the pair. It must be called while holding t.w.
+func (t *TradePair) snapshot() *Snapshot {
+	s := &Snapshot{
+		Symbol:      t.Symbol,
+		Sequence:    t.sequence,
+		Timestamp:   t.timestamp,
+		LatestPrice: t.TicksToPrice(t.latestPrice),
+		Status:      t.status,
+		AuctionEnd:  t.auctionEnd,
+
+		ReferencePrice: t.TicksToPrice(t.referencePrice),
+		AskSequence:    t.AsksOrderbook.seq,
+		BidSequence:    t.BidsOrderbook.seq,
+		StopSequence:   t.StopBook.seq,
+		Asks:           t.bookRecords(t.AsksOrderbook),
+		Bids:           t.bookRecords(t.BidsOrderbook),
+		Stops:          []*OrderRecord{},
+		Expiries:       make(map[string]int64),
+		STPModes:       make(map[string]STPMode),
+		Accounts:       make(map[string]BalanceRecord),
+		Tiers:          make(map[string]string),
+		Holds:          make(map[string]HoldRecord),
+		Orders:         []OrderState{},
+		ClientOrders:   []ClientOrderRecord{},
+	}
+
+	for _, item := range t.StopBook.List() {
+		s.Stops = append(s.Stops, t.orderRecord(item))
+	}
+	for uniq, expireTime := range t.expiries {
+		s.Expiries[uniq] = expireTime
+	}
+	for accountId, mode := range t.stpModes {
+		s.STPModes[accountId] = mode
+	}
+	for accountId, b := range t.accounts {
+		s.Accounts[accountId] = t.balanceRecord(b)
+	}
+	for accountId, tier := range t.tiers {
+		s.Tiers[accountId] = tier
+	}
+	for uniq, h := range t.holds {
+		s.Holds[uniq] = HoldRecord{AccountId: h.account, Asset: h.asset, Amount: t.assetToDecimal(h.asset, h.amount)}
+	}
+	open := []OrderState{}
+	for _, o := range t.orders {
+		if o.live() {
+			open = append(open, t.orderView(o))
+		}
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].OrderId < open[j].OrderId })
+	s.Orders = append(s.Orders, open...)
+	for _, uniq := range t.closed {
+		s.Orders = append(s.Orders, t.orderView(t.orders[uniq]))
+	}
+	for _, r := range t.clientIds {
+		if c, ok := t.clientOrders[clientOrderKey(r.AccountId, r.ClientOrderId)]; ok && c.id == r.OrderId {
+			s.ClientOrders = append(s.ClientOrders, r)
+		}
+	}
+	return s
+}
+
+// bookRecords lists the resting orders of a book in priority order.
+func (t *TradePair) bookRecords(ob *Orderbook) []*OrderRecord {
+	ob.Lock()
+	defer ob.Unlock()
+
+	res := make([]*OrderRecord, 0, ob.Len())
+	ob.Walk(func(item HeapItem) bool {
+		res = append(res, t.orderRecord(item))
+		return true
+	})
+	return res
+}
+
+func (t *TradePair) restore(s *Snapshot) {
+	t.sequence = s.Sequence
+	t.timestamp = s.Timestamp
+	t.latestPrice = t.PriceTicks(s.LatestPrice)
+	t.status = s.Status
+	t.auctionEnd = s.AuctionEnd
+	t.referencePrice = t.PriceTicks(s.ReferencePrice)
+
+	for _, r := range s.Asks {
+		t.AsksOrderbook.Restore(t.recordItem(r))
+	}
+	for _, r := range s.Bids {
+		t.BidsOrderbook.Restore(t.recordItem(r))
+	}
+	for _, r := range s.Stops {
+		t.StopBook.Push(t.recordItem(r))
+	}
+	t.AsksOrderbook.seq = s.AskSequence
+	t.BidsOrderbook.seq = s.BidSequence
+	t.StopBook.seq = s.StopSequence
+
+	for uniq, expireTime := range s.Expiries {
+		t.expiries[uniq] = expireTime
+	}
+	for accountId, mode := range s.STPModes {
+		t.stpModes[accountId] = mode
+	}
+	for accountId, r := range s.Accounts {
+		t.accounts[accountId] = &Balance{
+			Base:      t.QtyLots(r.Base),
+			BaseHold:  t.QtyLots(r.BaseHold),
+			Quote:     t.AmountUnits(r.Quote),
+			QuoteHold: t.AmountUnits(r.QuoteHold),
+		}
+	}
+	for accountId, tier := range s.Tiers {
+		t.tiers[accountId] = tier
+	}
+	for uniq, r := range s.Holds {
+		t.holds[uniq] = &hold{account: r.AccountId, asset: r.Asset, amount: t.assetUnits(r.Asset, r.Amount)}
+	}
+	for _, r := range s.ClientOrders {
+		t.clientOrders[clientOrderKey(r.AccountId, r.ClientOrderId)] = clientOrder{id: r.OrderId, time: r.Time}
+		t.clientIds = append(t.clientIds, r)
+	}
+	for _, v := range s.Orders {
+		o := t.stateRecord(v)
+		t.orders[o.id] = o
+		if !o.live() {
+			t.closed = append(t.closed, o.id)
+		}
+	}
+	// Snapshots written before client ids were kept on their own only have
+	// the orders, and open orders holding an id past the window were dropped
+	for _, v := range s.Orders {
+		o := t.orders[v.OrderId]
+		_, indexed := t.clientOrders[clientOrderKey(o.account, o.clientId)]
+		if s.ClientOrders == nil || (o.live() && !indexed) {
+			t.indexClientOrder(o.account, o.clientId, o.id, o.createTime)
+		}
+	}
+}
+
+func snapshotPath(symbol string, sequence int64) string {
+	return filepath.Join(*dataDir, fmt.Sprintf("%s-%020d.snapshot", symbol, sequence))
+}
+
+// listSnapshots returns the snapshot files of a pair, oldest first.
+func listSnapshots(symbol string) []string {
+	return sequencedFiles(symbol, ".snapshot")
+}
+
+// WriteSnapshot saves the current state of the pair. The file is written
+// under a temporary name and renamed into place once it is on disk, so a
+// crash never leaves a half written snapshot behind.
+func (t *TradePair) WriteSnapshot() error {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	return t.writeSnapshot()
+}
+
+func (t *TradePair) writeSnapshot() error {
+	if *dataDir == "" {
+		return nil
+	}
+
+	s := t.snapshot()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := snapshotPath(t.Symbol, s.Sequence)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(*dataDir); err != nil {
+		return err
+	}
+
+	files := listSnapshots(t.Symbol)
+	for i := 0; i < len(files)-snapshotKeep; i++ {
+		os.Remove(files[i])
+	}
+
+	// The journal up to the snapshot is only kept for the older snapshots
+	if err := t.rotateJournal(s.Sequence); err != nil {
+		return err
+	}
+
+	logrus.Infof("%s snapshot written at sequence %d", t.Symbol, s.Sequence)
+	return nil
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("Snapshot %s: %s", path, err)
+	}
+	return &s, nil
+}
+
+// loadSnapshot restores the latest readable snapshot of the pair and returns
+// its sequence, or 0 when there is none.
+func (t *TradePair) loadSnapshot() int64 {
+	if *dataDir == "" {
+		return 0
+	}
+
+	files := listSnapshots(t.Symbol)
+	for i := len(files) - 1; i >= 0; i-- {
+		s, err := ReadSnapshot(files[i])
+		if err != nil {
+			logrus.Warnf("%s", err)
+			continue
+		}
+		t.restore(s)
+		logrus.Infof("%s restored snapshot at sequence %d", t.Symbol, s.Sequence)
+		return s.Sequence
+	}
+	return 0
+}
+
+func (t *TradePair) snapshotTicker() {
+	if *snapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*snapshotInterval)
+	for {
+		<-ticker.C
+		if err := t.WriteSnapshot(); err != nil {
+			logrus.Errorf("%s snapshot: %s", t.Symbol, err)
+		}
+	}
+}
+
+// Shutdown stops the pair from applying any further command, writes a last
+// snapshot and closes the journal.
+func (t *TradePair) Shutdown() {
+	t.w.Lock()
+
+	if err := t.writeSnapshot(); err != nil {
+		logrus.Errorf("%s snapshot: %s", t.Symbol, err)
+	}
+	if t.journal != nil {
+		if err := t.journal.Close(); err != nil {
+			logrus.Errorf("%s journal close: %s", t.Symbol, err)
+		}
+	}
+}
+
+// InspectSnapshot prints a human readable dump of a snapshot file.
+func InspectSnapshot(path string, out io.Writer) error {
+	s, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "symbol:       %s\n", s.Symbol)
+	fmt.Fprintf(out, "sequence:     %d\n", s.Sequence)
+	fmt.Fprintf(out, "timestamp:    %s\n", time.Unix(0, s.Timestamp).UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(out, "latest price: %s\n", s.LatestPrice)
+	fmt.Fprintf(out, "reference:    %s\n", s.ReferencePrice)
+	fmt.Fprintf(out, "status:       %s\n", PairStatus2String(s.Status))
+	fmt.Fprintf(out, "asks: %d  bids: %d  stops: %d\n", len(s.Asks), len(s.Bids), len(s.Stops))
+
+	for _, side := range []struct {
+		name    string
+		records []*OrderRecord
+	}{{"ASKS", s.Asks}, {"BIDS", s.Bids}, {"STOPS", s.Stops}} {
+		fmt.Fprintf(out, "\n%s\n", side.name)
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PRIORITY\tORDER ID\tPRICE\tQUANTITY\tHIDDEN\tSTOP\tFLAGS")
+		for _, r := range side.records {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Sequence, r.OrderId, r.Price, r.Quantity, r.HiddenQty, r.StopPrice, r.flags(s.Expiries))
+		}
+		w.Flush()
+	}
+
+	accounts := make([]string, 0, len(s.Accounts))
+	for accountId := range s.Accounts {
+		accounts = append(accounts, accountId)
+	}
+	sort.Strings(accounts)
+
+	fmt.Fprintf(out, "\nACCOUNTS\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tBASE\tBASE HELD\tQUOTE\tQUOTE HELD")
+	for _, accountId := range accounts {
+		b := s.Accounts[accountId]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", accountId, b.Base, b.BaseHold, b.Quote, b.QuoteHold)
+	}
+	w.Flush()
+	return nil
+}
+
+func (r *OrderRecord) flags(expiries map[string]int64) string {
+	flags := []string{PriceType2String(r.PriceType)}
+	switch r.TimeInForce {
+	case TimeInForceIOC:
+		flags = append(flags, "ioc")
+	case TimeInForceFOK:
+		flags = append(flags, "fok")
+	case TimeInForceGTD:
+		flags = append(flags, "gtd="+strconv.FormatInt(expiries[r.OrderId], 10))
+	}
+	if r.PostOnly {
+		flags = append(flags, "post_only")
+	}
+	if r.AccountId != "" {
+		flags = append(flags, "account="+r.AccountId)
+	}
+	if r.STPMode != STPNone {
+		flags = append(flags, "stp="+STPMode2String(r.STPMode))
+	}
+	if r.DisplayQty.Sign() > 0 {
+		flags = append(flags, "iceberg="+r.DisplayQty.String())
+	}
+	return strings.Join(flags, ",")
+}
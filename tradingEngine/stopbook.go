@@ -0,0 +1,127 @@
+package main
+
+type stopEntry struct {
+	item HeapItem
+	seq  int64
+}
+
+// StopBook holds stop and stop-limit orders until the last trade price reaches
+// their stop price. Buy stops are kept by ascending stop price and sell stops by
+// descending stop price, ties broken by arrival, so that triggering always
+// happens in the same order.
+type StopBook struct {
+	buys  []*stopEntry
+	sells []*stopEntry
+	m     map[string]*stopEntry
+	seq   int64
+}
+
+func NewStopBook() *StopBook {
+	return &StopBook{
+		buys:  make([]*stopEntry, 0),
+		sells: make([]*stopEntry, 0),
+		m:     make(map[string]*stopEntry),
+	}
+}
+
+func (s *StopBook) Len() int {
+	return len(s.m)
+}
+
+func (s *StopBook) Push(item HeapItem) (exist bool) {
+	id := item.GetUniqueId()
+	if _, ok := s.m[id]; ok {
+		return true
+	}
+
+	s.seq++
+	entry := &stopEntry{item: item, seq: s.seq}
+	s.m[id] = entry
+
+	if item.GetOrderSide() == OrderSideBuy {
+		s.buys = insertStop(s.buys, entry, func(e *stopEntry) bool {
+			return e.item.GetStopPrice() > item.GetStopPrice()
+		})
+	} else {
+		s.sells = insertStop(s.sells, entry, func(e *stopEntry) bool {
+			return e.item.GetStopPrice() < item.GetStopPrice()
+		})
+	}
+	return false
+}
+
+// insertStop puts the entry in front of the first entry for which after is true.
+func insertStop(entries []*stopEntry, entry *stopEntry, after func(e *stopEntry) bool) []*stopEntry {
+	i := 0
+	for i < len(entries) && !after(entries[i]) {
+		i++
+	}
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
+
+func (s *StopBook) Find(uniqId string) HeapItem {
+	if entry, ok := s.m[uniqId]; ok {
+		return entry.item
+	}
+	return nil
+}
+
+func (s *StopBook) Remove(uniqId string) HeapItem {
+	entry, ok := s.m[uniqId]
+	if !ok {
+		return nil
+	}
+	delete(s.m, uniqId)
+
+	if entry.item.GetOrderSide() == OrderSideBuy {
+		s.buys = removeStop(s.buys, entry)
+	} else {
+		s.sells = removeStop(s.sells, entry)
+	}
+	return entry.item
+}
+
+func removeStop(entries []*stopEntry, entry *stopEntry) []*stopEntry {
+	for i, e := range entries {
+		if e == entry {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+// Triggered removes and returns every stop order reached by the last price.
+// Buy stops come first, lowest stop price first, followed by sell stops,
+// highest stop price first.
+func (s *StopBook) Triggered(lastPrice int64) []HeapItem {
+	res := []HeapItem{}
+
+	for len(s.buys) > 0 && s.buys[0].item.GetStopPrice() <= lastPrice {
+		res = append(res, s.buys[0].item)
+		delete(s.m, s.buys[0].item.GetUniqueId())
+		s.buys = s.buys[1:]
+	}
+
+	for len(s.sells) > 0 && s.sells[0].item.GetStopPrice() >= lastPrice {
+		res = append(res, s.sells[0].item)
+		delete(s.m, s.sells[0].item.GetUniqueId())
+		s.sells = s.sells[1:]
+	}
+
+	return res
+}
+
+// List returns the pending stop orders in trigger order.
+func (s *StopBook) List() []HeapItem {
+	res := make([]HeapItem, 0, s.Len())
+	for _, e := range s.buys {
+		res = append(res, e.item)
+	}
+	for _, e := range s.sells {
+		res = append(res, e.item)
+	}
+	return res
+}
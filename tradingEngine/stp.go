@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+const CancelReasonSelfTrade = "self_trade_prevention"
+
+// STPResult reports a match that was prevented because both orders belong to
+// the same account.
+type STPResult struct {
+	Symbol       string          `json:"symbol"`
+	Mode         string          `json:"mode"`
+	TakerOrderId string          `json:"taker_order_id"`
+	MakerOrderId string          `json:"maker_order_id"`
+	Quantity     decimal.Decimal `json:"quantity"`
+	Cancelled    []string        `json:"cancelled"`
+	Sequence     int64           `json:"sequence"`
+}
+
+// SetAccountSTPMode queues the default self-trade prevention mode of an
+// account, used by its orders that do not carry a mode of their own.
+func (t *TradePair) SetAccountSTPMode(accountId string, mode STPMode) CommandResult {
+	return t.submit(Command{
+		Type:      CommandSetAccountSTP,
+		AccountId: accountId,
+		STPMode:   mode,
+	})
+}
+
+func (t *TradePair) handlerSetAccountSTP(accountId string, mode STPMode) string {
+	if accountId == "" {
+		return RejectReasonNoAccount
+	}
+	if mode == STPNone {
+		delete(t.stpModes, accountId)
+	} else {
+		t.stpModes[accountId] = mode
+	}
+	return ""
+}
+
+// stpMode picks the mode of the order itself, falling back to its account.
+func (t *TradePair) stpMode(item HeapItem) STPMode {
+	if item.GetAccountId() == "" {
+		return STPNone
+	}
+	if item.GetSTPMode() != STPNone {
+		return item.GetSTPMode()
+	}
+	return t.stpModes[item.GetAccountId()]
+}
+
+func isSelfTrade(taker, maker HeapItem) bool {
+	return taker.GetAccountId() != "" && taker.GetAccountId() == maker.GetAccountId()
+}
+
+// preventSelfTrade resolves a taker meeting a maker of the same account
+// without trading. It reports whether the taker is done.
+func (t *TradePair) preventSelfTrade(mode STPMode, book *Orderbook, taker, maker HeapItem) bool {
+	result := STPResult{
+		Symbol:       t.Symbol,
+		Mode:         STPMode2String(mode),
+		TakerOrderId: taker.GetUniqueId(),
+		MakerOrderId: maker.GetUniqueId(),
+		Cancelled:    []string{},
+	}
+
+	cancelTaker, cancelMaker := false, false
+	switch mode {
+	case STPCancelNewest:
+		cancelTaker = true
+	case STPCancelOldest:
+		cancelMaker = true
+	case STPCancelBoth:
+		cancelTaker, cancelMaker = true, true
+	case STPDecrementCancel:
+		makerOpen := maker.GetQuantity() + maker.GetHiddenQuantity()
+		takerOpen := taker.GetQuantity()
+		if byAmount(taker) && maker.GetPrice() > 0 {
+			takerOpen = taker.GetAmount() / maker.GetPrice()
+		}
+		qty := min64(makerOpen, takerOpen)
+		result.Quantity = t.LotsToQty(qty)
+
+		cancelTaker = takerOpen <= qty
+		cancelMaker = makerOpen <= qty
+		if !cancelMaker {
+			open := makerOpen - qty
+			visible := min64(maker.GetQuantity(), open)
+			maker.SetQuantity(visible)
+			maker.SetHiddenQuantity(open - visible)
+			book.Update(maker)
+		}
+		if !cancelTaker && byAmount(taker) {
+			taker.SetAmount(taker.GetAmount() - qty*maker.GetPrice())
+		} else if !cancelTaker {
+			taker.SetQuantity(taker.GetQuantity() - qty)
+		}
+	}
+
+	if cancelMaker {
+		book.Remove(maker.GetUniqueId())
+		delete(t.expiries, maker.GetUniqueId())
+		result.Cancelled = append(result.Cancelled, maker.GetUniqueId())
+	}
+	if cancelTaker {
+		taker.SetQuantity(0)
+		taker.SetAmount(0)
+		result.Cancelled = append(result.Cancelled, taker.GetUniqueId())
+	}
+
+	t.sendSTPNotify(result)
+	for _, uniq := range result.Cancelled {
+		t.sendCancelNotify(uniq, CancelReasonSelfTrade)
+	}
+	return cancelTaker
+}
+
+func (t *TradePair) sendSTPNotify(result STPResult) {
+	result.Sequence = t.sequence
+	if t.replaying {
+		return
+	}
+	t.output(JournalRecord{Kind: RecordSTP, Sequence: t.sequence, STP: &result})
+}
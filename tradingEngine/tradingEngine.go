@@ -1,7 +1,7 @@
 package main
 
 import (
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -17,151 +17,513 @@ type TradeResult struct {
 	TradePrice    decimal.Decimal `json:"trade_price"`
 	TradeAmount   decimal.Decimal `json:"trade_amount"`
 	TradeTime     int64           `json:"trade_time"`
+	Sequence      int64           `json:"sequence"`
+
+	// the side of the order that took liquidity, and the fees of both sides
+	TakerSide   string          `json:"taker_side"`
+	AskFee      decimal.Decimal `json:"ask_fee"`
+	AskFeeAsset string          `json:"ask_fee_asset"`
+	BidFee      decimal.Decimal `json:"bid_fee"`
+	BidFeeAsset string          `json:"bid_fee_asset"`
+}
+
+const (
+	CancelReasonUser       = "user_cancel"
+	CancelReasonUnfilled   = "unfilled_remainder"
+	CancelReasonFillOrKill = "fill_or_kill"
+	CancelReasonExpired    = "expired"
+)
+
+type CancelResult struct {
+	Symbol   string `json:"symbol"`
+	OrderId  string `json:"order_id"`
+	Reason   string `json:"reason"`
+	Sequence int64  `json:"sequence"`
+}
+
+const (
+	PostOnlyActionRejected = "rejected"
+	PostOnlyActionRepriced = "repriced"
+
+	RejectReasonPostOnly = "post_only_would_take"
+)
+
+type PostOnlyResult struct {
+	Symbol        string          `json:"symbol"`
+	OrderId       string          `json:"order_id"`
+	Action        string          `json:"action"`
+	OriginalPrice decimal.Decimal `json:"original_price"`
+	Price         decimal.Decimal `json:"price"`
+	Sequence      int64           `json:"sequence"`
 }
 
 type TradePair struct {
-	Symbol         string
-	ChTradeResult  chan TradeResult
-	ChNewOrder     chan HeapItem
-	ChCancelResult chan string
+	Symbol    string
+	ChCommand chan Command
+	// every result of the pair in the order it was produced, as its journal
+	// record tagged with the sequence of its command
+	ChOutput chan JournalRecord
 
 	priceDigit    int
 	quantityDigit int
-	miniTradeQty  decimal.Decimal
-	latestPrice   decimal.Decimal
+	rules         tradingRules
+	latestPrice   int64
+	status        PairStatus
+	// when a timed auction or halt ends, zero when it has to be ended by hand
+	auctionEnd int64
+	// centre of the static price band, set by the opening uncross or else
+	// the first trade
+	referencePrice int64
+	// id of the new order being handled
+	incoming string
 
 	BidsOrderbook *Orderbook
 	AsksOrderbook *Orderbook
+	StopBook      *StopBook
+
+	// expire time of resting GTD orders, keyed by order id
+	expiries map[string]int64
+	// default self-trade prevention mode, keyed by account id
+	stpModes map[string]STPMode
+
+	accounts map[string]*Balance
+	// fee tier, keyed by account id
+	tiers map[string]string
+	// reservations of open orders, keyed by order id
+	holds map[string]*hold
+	// orders the current command may have closed
+	touched map[string]bool
+
+	// open and recently closed orders, and the ids of the closed ones, oldest first
+	orders map[string]*orderState
+	closed []string
+
+	// orders by account and client order id for the retention window, and
+	// the ids as they were given, oldest first, to expire them
+	clientOrders map[string]clientOrder
+	clientIds    []ClientOrderRecord
+
+	// sequence and timestamp of the command being applied
+	sequence  int64
+	timestamp int64
+
+	journal        *Journal
+	replaying      bool
+	replayedTrades []TradeResult
 
 	w sync.Mutex
 }
 
-func NewTradePair(symbol string, priceDigit, quantityDigit int) *TradePair {
+func NewTradePair(symbol string, priceDigit, quantityDigit int, rules TradingRules) (*TradePair, error) {
 	t := &TradePair{
-		Symbol:         symbol,
-		ChTradeResult:  make(chan TradeResult, 10),
-		ChNewOrder:     make(chan HeapItem),
-		ChCancelResult: make(chan string, 10),
+		Symbol:    symbol,
+		ChCommand: make(chan Command),
+		ChOutput:  make(chan JournalRecord, 100),
 
 		priceDigit:    priceDigit,
 		quantityDigit: quantityDigit,
-		miniTradeQty:  decimal.New(1, int32(-quantityDigit)),
 
-		AsksOrderbook: NewOrderBook(),
-		BidsOrderbook: NewOrderBook(),
+		AsksOrderbook: NewOrderBook(OrderSideSell),
+		BidsOrderbook: NewOrderBook(OrderSideBuy),
+		StopBook:      NewStopBook(),
+
+		expiries: make(map[string]int64),
+		stpModes: make(map[string]STPMode),
+
+		accounts: make(map[string]*Balance),
+		tiers:    make(map[string]string),
+		holds:    make(map[string]*hold),
+		touched:  make(map[string]bool),
+		orders:   make(map[string]*orderState),
+
+		clientOrders: make(map[string]clientOrder),
+	}
+	if err := t.setRules(rules); err != nil {
+		return nil, err
 	}
 
-	// todo: depth handling
+	t.openJournal()
 
-	go t.depthTicker(t.AsksOrderbook)
-	go t.depthTicker(t.BidsOrderbook)
+	go t.expireTicker()
+	go t.snapshotTicker()
 
-	go t.matching()
-	return t
+	go t.sequencer()
+	return t, nil
 }
 
-func (t *TradePair) matching() {
+// handlerNewOrder matches an incoming order against resting liquidity straight
+// away and only lets it rest afterwards, so the book is never left crossed.
+func (t *TradePair) handlerNewOrder(newOrder HeapItem) string {
+	// An id already in use must not touch the order that holds it
+	if reason := t.idReject(newOrder); reason != "" {
+		t.sendRejectResult(newOrder.GetUniqueId(), reason)
+		return reason
+	}
+	t.trackOrder(newOrder)
+	if reason := t.orderReject(newOrder); reason != "" {
+		t.sendRejectNotify(newOrder.GetUniqueId(), reason)
+		return reason
+	}
+	t.reserve(newOrder)
+	t.orderAccepted(newOrder.GetUniqueId())
+	t.incoming = newOrder.GetUniqueId()
+	reason := t.processOrder(newOrder)
+	t.incoming = ""
+	t.triggerStops()
+	return reason
+}
 
-	for {
-		select {
-		case newOrder := <-t.ChNewOrder:
-			go t.handlerNewOrder(newOrder)
-		default:
-			t.handlerLimitOrder()
+// idReject is the reason the ids of a new order cannot be used, or an empty
+// string. Ids of recently closed orders are still taken.
+func (t *TradePair) idReject(item HeapItem) string {
+	uniq := item.GetUniqueId()
+	if uniq == "" {
+		return RejectReasonNoOrderId
+	}
+	if _, ok := t.orders[uniq]; ok || t.openOrder(uniq) != nil {
+		return RejectReasonDuplicateId
+	}
+	if t.clientOrderTaken(item.GetAccountId(), item.GetClientOrderId()) {
+		return RejectReasonDuplicateClientId
+	}
+	return ""
+}
+
+// processOrder matches, rests or parks an accepted order. It returns the
+// reason the order was refused on the way, or an empty string.
+func (t *TradePair) processOrder(newOrder HeapItem) string {
+	pt := newOrder.GetPriceType()
+	if pt == PriceTypeStop || pt == PriceTypeStopLimit {
+		if newOrder.GetTimeInForce() == TimeInForceGTD {
+			t.expiries[newOrder.GetUniqueId()] = newOrder.GetExpireTime()
 		}
+		t.StopBook.Push(newOrder)
+		return ""
+	}
+
+	if t.status != PairStatusOpen {
+		return t.restOrder(newOrder)
+	}
+
+	// Market orders never rest, so anything but FOK behaves as IOC
+	tif := newOrder.GetTimeInForce()
+	if newOrder.GetPriceType() == PriceTypeMarket && tif != TimeInForceFOK {
+		tif = TimeInForceIOC
+	}
 
+	if newOrder.IsPostOnly() && newOrder.GetPriceType() == PriceTypeLimit {
+		if reason := t.handlerPostOnly(newOrder); reason != "" {
+			return reason
+		}
 	}
 
+	switch tif {
+	case TimeInForceIOC:
+		if ok, reason := t.matchTaker(newOrder); !ok {
+			return reason
+		}
+		if t.unfilled(newOrder) {
+			t.sendCancelNotify(newOrder.GetUniqueId(), CancelReasonUnfilled)
+		}
+	case TimeInForceFOK:
+		if !t.canFill(newOrder) {
+			t.sendCancelNotify(newOrder.GetUniqueId(), CancelReasonFillOrKill)
+			return ""
+		}
+		if ok, reason := t.matchTaker(newOrder); !ok {
+			return reason
+		}
+		if t.unfilled(newOrder) {
+			t.sendCancelNotify(newOrder.GetUniqueId(), CancelReasonUnfilled)
+		}
+	case TimeInForceGTD:
+		if newOrder.GetExpireTime() <= t.timestamp {
+			t.sendCancelNotify(newOrder.GetUniqueId(), CancelReasonExpired)
+			return ""
+		}
+		if ok, reason := t.matchTaker(newOrder); !ok {
+			return reason
+		}
+		if t.unfilled(newOrder) {
+			t.expiries[newOrder.GetUniqueId()] = newOrder.GetExpireTime()
+			t.pushOrder(newOrder)
+		}
+	default:
+		if ok, reason := t.matchTaker(newOrder); !ok {
+			return reason
+		}
+		if t.unfilled(newOrder) {
+			t.pushOrder(newOrder)
+		}
+	}
+	return ""
 }
 
-func (t *TradePair) handlerNewOrder(newOrder HeapItem) {
-	t.w.Lock()
-	defer t.w.Unlock()
+// handlerPostOnly makes sure a post-only order cannot take liquidity. When it
+// would cross the opposite top it is either rejected or slid to the nearest
+// valid tick behind the best opposite price, depending on its mode. It returns the reason when
+// the order has been rejected.
+func (t *TradePair) handlerPostOnly(order HeapItem) string {
+	book := t.oppositeBook(order)
+	if book.Len() == 0 || !crosses(order, book.Root().GetPrice()) {
+		return ""
+	}
 
-	if newOrder.GetPriceType() == PriceTypeLimit {
-		if newOrder.GetOrderSide() == OrderSideSell {
-			t.AsksOrderbook.Push(newOrder)
-		} else {
-			t.BidsOrderbook.Push(newOrder)
+	result := PostOnlyResult{
+		Symbol:        t.Symbol,
+		OrderId:       order.GetUniqueId(),
+		OriginalPrice: t.TicksToPrice(order.GetPrice()),
+		Sequence:      t.sequence,
+	}
+
+	if order.GetPostOnlyMode() == PostOnlySlide {
+		best, tick := book.Root().GetPrice(), t.rules.tick
+		price := (best/tick + 1) * tick
+		if order.GetOrderSide() == OrderSideBuy {
+			price = (best - 1) / tick * tick
+		}
+
+		// A buy cannot slide below the smallest tick
+		if price > 0 {
+			order.SetPrice(price)
+			t.orderRepriced(order.GetUniqueId(), price)
+			result.Action = PostOnlyActionRepriced
+			result.Price = t.TicksToPrice(price)
+			t.sendPostOnlyNotify(result)
+			return ""
 		}
 	}
+
+	result.Action = PostOnlyActionRejected
+	result.Price = t.TicksToPrice(order.GetPrice())
+	t.orderRejected(order.GetUniqueId(), RejectReasonPostOnly)
+	t.sendPostOnlyNotify(result)
+	return RejectReasonPostOnly
 }
 
-func (t *TradePair) handlerLimitOrder() {
-	ok := func() bool {
-		t.w.Lock()
-		defer t.w.Unlock()
+func (t *TradePair) sendPostOnlyNotify(result PostOnlyResult) {
+	if t.replaying {
+		return
+	}
+	t.output(JournalRecord{Kind: RecordPostOnly, Sequence: t.sequence, PostOnly: &result})
+}
 
-		if t.AsksOrderbook == nil || t.BidsOrderbook == nil {
-			return false
+// triggerStops releases the stop orders reached by the latest trade price into
+// matching. Their own trades may move the price further, so it keeps going
+// until no more stops are reached.
+func (t *TradePair) triggerStops() {
+	if t.latestPrice <= 0 || t.status != PairStatusOpen {
+		return
+	}
+
+	// A stop breaching the price bands may stop matching on the way
+	for t.status == PairStatusOpen {
+		triggered := t.StopBook.Triggered(t.latestPrice)
+		if len(triggered) == 0 {
+			return
+		}
+
+		for _, item := range triggered {
+			if item.GetPriceType() == PriceTypeStop {
+				item.SetPriceType(PriceTypeMarket)
+			} else {
+				item.SetPriceType(PriceTypeLimit)
+			}
+			delete(t.expiries, item.GetUniqueId())
+			t.processOrder(item)
 		}
+	}
+}
+
+func (t *TradePair) pushOrder(item HeapItem) {
+	item.Hide()
+	if item.GetOrderSide() == OrderSideSell {
+		t.AsksOrderbook.Push(item)
+	} else {
+		t.BidsOrderbook.Push(item)
+	}
+}
+
+// settleOrder takes a filled resting order off the book, unless it is an
+// iceberg with hidden reserve left. The refilled slice then loses its time
+// priority and queues behind the other orders at its price.
+func (t *TradePair) settleOrder(book *Orderbook, item HeapItem) {
+	if item.GetQuantity() > 0 {
+		book.Update(item)
+		return
+	}
+	if item.Replenish() {
+		book.Requeue(item)
+		return
+	}
+	book.Remove(item.GetUniqueId())
+}
+
+func (t *TradePair) oppositeBook(taker HeapItem) *Orderbook {
+	if taker.GetOrderSide() == OrderSideSell {
+		return t.BidsOrderbook
+	}
+	return t.AsksOrderbook
+}
+
+// byAmount reports whether the order is a market buy sized by quote amount.
+func byAmount(taker HeapItem) bool {
+	return taker.GetPriceType() == PriceTypeMarket && taker.GetOrderSide() == OrderSideBuy && taker.GetQuantity() <= 0
+}
 
-		if t.AsksOrderbook.Len() == 0 || t.BidsOrderbook.Len() == 0 {
+// crosses reports whether the taker is willing to trade at a resting price.
+func crosses(taker HeapItem, price int64) bool {
+	if taker.GetPriceType() == PriceTypeMarket {
+		return true
+	}
+	if taker.GetOrderSide() == OrderSideBuy {
+		return taker.GetPrice() >= price
+	}
+	return taker.GetPrice() <= price
+}
+
+func (t *TradePair) unfilled(taker HeapItem) bool {
+	if byAmount(taker) {
+		return taker.GetAmount() > 0
+	}
+	return taker.GetQuantity() > 0
+}
+
+// canFill reports whether the crossing liquidity on the opposite side is enough
+// to fill the taker completely. Liquidity outside the price bands does not
+// count.
+func (t *TradePair) canFill(taker HeapItem) bool {
+	book := t.oppositeBook(taker)
+	stp := t.stpMode(taker)
+	low, high := t.bandLimits(t.latestPrice)
+	var available, cost int64
+	book.Walk(func(maker HeapItem) bool {
+		if !crosses(taker, maker.GetPrice()) || !inBand(maker.GetPrice(), low, high) {
 			return false
 		}
+		// Own orders never trade with the taker. Only cancel oldest lets it
+		// carry on past them, every other mode ends its matching there.
+		if stp != STPNone && isSelfTrade(taker, maker) {
+			return stp == STPCancelOldest
+		}
+		qty := maker.GetQuantity() + maker.GetHiddenQuantity()
+		if byAmount(taker) {
+			available = addCapped(available, notional(qty, maker.GetPrice()))
+		} else if available < taker.GetQuantity() {
+			cost = addCapped(cost, notional(min64(qty, taker.GetQuantity()-available), maker.GetPrice()))
+			available += qty
+		}
+		return true
+	})
 
-		askTop := t.AsksOrderbook.Root()
-		bidTop := t.BidsOrderbook.Root()
+	if byAmount(taker) {
+		return available >= taker.GetAmount()
+	}
+	// A bid also has to be able to pay for all of it
+	if taker.GetOrderSide() == OrderSideBuy && cost > t.heldFor(taker.GetUniqueId()) {
+		return false
+	}
+	return available >= taker.GetQuantity()
+}
 
-		defer func() {
-			if askTop.GetQuantity().Equal(decimal.Zero) {
-				t.AsksOrderbook.Remove(askTop.GetUniqueId())
+// matchTaker fills the taker against the opposite side of the book for as long
+// as prices cross. Trades print at the resting order's price. A market buy
+// without a quantity is sized by its quote amount instead. It returns false
+// when a price band stopped the taker, which has then been dealt with, along
+// with the reason the taker was refused if it was.
+func (t *TradePair) matchTaker(taker HeapItem) (bool, string) {
+	book := t.oppositeBook(taker)
+	amountSized := byAmount(taker)
+	stp := t.stpMode(taker)
+	low, high := t.bandLimits(t.latestPrice)
+	filled := false
+
+	for book.Len() > 0 {
+		maker := book.Root()
+		price := maker.GetPrice()
+		if !crosses(taker, price) {
+			return true, ""
+		}
+
+		if !inBand(price, low, high) {
+			return false, t.bandBreach(taker, price, low, high, filled)
+		}
+
+		if stp != STPNone && isSelfTrade(taker, maker) {
+			if t.preventSelfTrade(stp, book, taker, maker) {
+				return true, ""
 			}
-			if bidTop.GetQuantity().Equal(decimal.Zero) {
-				t.BidsOrderbook.Remove(bidTop.GetUniqueId())
+			continue
+		}
+
+		var tradeQty int64
+		if amountSized {
+			if price > 0 {
+				tradeQty = min64(taker.GetAmount()/price, maker.GetQuantity())
 			}
-		}()
-
-		if bidTop.GetPrice().Cmp(askTop.GetPrice()) >= 0 {
-			curTradeQty := decimal.Zero
-			curTradePrice := decimal.Zero
-			if bidTop.GetQuantity().Cmp(askTop.GetQuantity()) >= 0 {
-				curTradeQty = askTop.GetQuantity()
-			} else if bidTop.GetQuantity().Cmp(askTop.GetQuantity()) == -1 {
-				curTradeQty = bidTop.GetQuantity()
+			if tradeQty <= 0 {
+				return true, ""
 			}
-			askTop.SetQuantity(askTop.GetQuantity().Sub(curTradeQty))
-			bidTop.SetQuantity(bidTop.GetQuantity().Sub(curTradeQty))
-
-			if askTop.GetCreateTime() >= bidTop.GetCreateTime() {
-				curTradePrice = bidTop.GetPrice()
-			} else {
-				curTradePrice = askTop.GetPrice()
+			taker.SetAmount(taker.GetAmount() - tradeQty*price)
+		} else {
+			// A bid without a price can only buy what its reservation pays for
+			tradeQty = t.affordable(taker, price, min64(taker.GetQuantity(), maker.GetQuantity()))
+			if tradeQty <= 0 {
+				return true, ""
 			}
+			taker.SetQuantity(taker.GetQuantity() - tradeQty)
+		}
+		maker.SetQuantity(maker.GetQuantity() - tradeQty)
+		filled = true
 
-			t.sendTradeResultNotify(askTop, bidTop, curTradePrice, curTradeQty, "")
-			return true
+		if taker.GetOrderSide() == OrderSideSell {
+			t.sendTradeResultNotify(taker, maker, price, tradeQty, OrderSideSell)
 		} else {
-			return false
+			t.sendTradeResultNotify(maker, taker, price, tradeQty, OrderSideBuy)
 		}
 
-	}()
-
-	if !ok {
-		time.Sleep(time.Duration(60) * time.Millisecond)
-	} else {
-		if Debug {
-			time.Sleep(time.Second * time.Duration(1))
+		t.settleOrder(book, maker)
+		if !t.unfilled(taker) {
+			return true, ""
 		}
 	}
+	return true, ""
 }
 
-func (t *TradePair) sendTradeResultNotify(ask, bid HeapItem, price, tradeQty decimal.Decimal, market_done string) {
+func (t *TradePair) sendTradeResultNotify(ask, bid HeapItem, price, tradeQty int64, takerSide OrderSide) {
+	askFee, bidFee := t.tradeFees(ask, bid, price, tradeQty, takerSide)
+
 	tradelog := TradeResult{}
 	tradelog.Symbol = t.Symbol
 	tradelog.AskOrderId = ask.GetUniqueId()
 	tradelog.BidOrderId = bid.GetUniqueId()
-	tradelog.TradeQuantity = tradeQty
-	tradelog.TradePrice = price
-	tradelog.TradeTime = time.Now().UnixNano()
-	tradelog.TradeAmount = tradeQty.Mul(price)
+	tradelog.TradeQuantity = t.LotsToQty(tradeQty)
+	tradelog.TradePrice = t.TicksToPrice(price)
+	tradelog.TradeTime = t.timestamp
+	tradelog.TradeAmount = t.UnitsToAmount(tradeQty * price)
+	tradelog.Sequence = t.sequence
+	tradelog.TakerSide = OrderSide2String(takerSide)
+	tradelog.AskFee = t.UnitsToAmount(askFee)
+	tradelog.AskFeeAsset = AssetQuote
+	tradelog.BidFee = t.LotsToQty(bidFee)
+	tradelog.BidFeeAsset = AssetBase
+	t.settleFunds(ask, bid, price, tradeQty, askFee, bidFee)
+	t.orderFilled(ask, price, tradeQty, askFee, AssetQuote)
+	t.orderFilled(bid, price, tradeQty, bidFee, AssetBase)
 	t.latestPrice = price
+	if t.referencePrice == 0 {
+		t.referencePrice = price
+	}
+
+	if t.replaying {
+		return
+	}
 
 	if Debug {
 		logrus.Infof("%s tradelog: %+v", t.Symbol, tradelog)
 	}
 
-	t.ChTradeResult <- tradelog
+	t.output(JournalRecord{Kind: RecordTrade, Sequence: t.sequence, Trade: &tradelog})
 }
 
 func (t *TradePair) AskLen() int {
@@ -178,16 +540,114 @@ func (t *TradePair) BidLen() int {
 	return t.BidsOrderbook.Len()
 }
 
-func (t *TradePair) CancelOrder(uniq string) {
+// handlerCancelOrder only reports a cancel for an order that was still open.
+func (t *TradePair) handlerCancelOrder(uniq string) string {
+	if t.removeOrder(uniq) == nil {
+		return RejectReasonUnknownOrder
+	}
+	t.sendCancelNotify(uniq, CancelReasonUser)
+	return ""
+}
+
+func (t *TradePair) handlerCancelStopOrder(uniq string) string {
+	if t.StopBook.Find(uniq) == nil {
+		return RejectReasonUnknownOrder
+	}
+	return t.handlerCancelOrder(uniq)
+}
+
+func (t *TradePair) GetStopOrders() []HeapItem {
 	t.w.Lock()
 	defer t.w.Unlock()
-	
-	// Get first char of uniq to determine which queue to remove
-	if strings.HasPrefix(uniq, "a-") {
-		t.AsksOrderbook.Remove(uniq)
-	} else {
-		t.BidsOrderbook.Remove(uniq)
+
+	return t.StopBook.List()
+}
+
+func (t *TradePair) removeOrder(uniq string) HeapItem {
+	delete(t.expiries, uniq)
+	t.touched[uniq] = true
+
+	if item := t.StopBook.Remove(uniq); item != nil {
+		return item
+	}
+
+	// The id says nothing about the side, so ask the books
+	if item := t.AsksOrderbook.Remove(uniq); item != nil {
+		return item
+	}
+	return t.BidsOrderbook.Remove(uniq)
+}
+
+func (t *TradePair) sendCancelNotify(uniq, reason string) {
+	t.touched[uniq] = true
+	t.orderCancelled(uniq, reason)
+	if t.replaying {
+		return
+	}
+
+	result := CancelResult{
+		Symbol:   t.Symbol,
+		OrderId:  uniq,
+		Reason:   reason,
+		Sequence: t.sequence,
+	}
+	t.output(JournalRecord{Kind: RecordCancel, Sequence: t.sequence, Cancel: &result})
+}
+
+// expireTicker asks the sequencer to expire GTD orders once any of them is
+// due, and to end a timed auction once it is over.
+func (t *TradePair) expireTicker() {
+	ticker := time.NewTicker(time.Second)
+
+	for {
+		<-ticker.C
+		now := time.Now().UnixNano()
+		if t.hasExpired(now) {
+			t.ChCommand <- Command{
+				Type:      CommandExpireOrders,
+				Timestamp: now,
+			}
+		}
+		if t.auctionDue(now) {
+			t.ChCommand <- Command{
+				Type:      CommandEndAuction,
+				Timestamp: now,
+			}
+		}
+	}
+}
+
+func (t *TradePair) hasExpired(now int64) bool {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	for _, expireTime := range t.expiries {
+		if expireTime <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// expireOrders cancels every GTD order whose expire time has passed, earliest
+// expiry first.
+func (t *TradePair) expireOrders(now int64) {
+	expired := []string{}
+	for uniq, expireTime := range t.expiries {
+		if expireTime <= now {
+			expired = append(expired, uniq)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		if t.expiries[expired[i]] != t.expiries[expired[j]] {
+			return t.expiries[expired[i]] < t.expiries[expired[j]]
+		}
+		return expired[i] < expired[j]
+	})
+
+	for _, uniq := range expired {
+		if t.removeOrder(uniq) != nil {
+			t.sendCancelNotify(uniq, CancelReasonExpired)
+		}
 	}
-	// Callback when removed
-	t.ChCancelResult <- uniq
 }
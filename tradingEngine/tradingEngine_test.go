@@ -0,0 +1,643 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestMain(m *testing.M) {
+	// Snapshots are only written when a test asks for one
+	*snapshotInterval = 0
+	Debug = false
+	os.Exit(m.Run())
+}
+
+// testPair opens a pair journaling into a fresh directory, with asks sent by
+// the seller and bids by the buyer, both funded.
+func testPair(t testing.TB, rules TradingRules) *TradePair {
+	*dataDir = t.TempDir()
+
+	pair, err := NewTradePair("test", 2, 4, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go drain(pair)
+	fund(pair, "seller")
+	fund(pair, "buyer")
+	return pair
+}
+
+func fund(pair *TradePair, account string) {
+	pair.Transfer(account, AssetBase, pair.QtyLots(decimal.NewFromInt(1000)))
+	pair.Transfer(account, AssetQuote, pair.AmountUnits(decimal.NewFromInt(1000000)))
+}
+
+// drain keeps the outputs of a pair flowing, as watchTradeLog does.
+func drain(pair *TradePair) {
+	for range pair.ChOutput {
+	}
+}
+
+type orderOption func(pair *TradePair, item HeapItem)
+
+func account(id string, mode STPMode) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetAccount(id, mode) }
+}
+
+func tif(tif TimeInForce) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetTimeInForce(tif, 0) }
+}
+
+func expireAt(ts int64) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetTimeInForce(TimeInForceGTD, ts) }
+}
+
+func postOnly(mode PostOnlyMode) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetPostOnly(true, mode) }
+}
+
+func display(qty string) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetDisplayQuantity(pair.QtyLots(dec(qty))) }
+}
+
+func stopAt(price string) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetStopPrice(pair.PriceTicks(dec(price))) }
+}
+
+func amount(a string) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetAmount(pair.AmountUnits(dec(a))) }
+}
+
+func clientId(id string) orderOption {
+	return func(pair *TradePair, item HeapItem) { item.SetClientOrderId(id) }
+}
+
+func dec(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+// place sends an order, an ask when id starts with "a" and a bid otherwise.
+func place(pair *TradePair, pt PriceType, id, price, qty string, opts ...orderOption) CommandResult {
+	p, q := pair.PriceTicks(dec(price)), pair.QtyLots(dec(qty))
+	var item HeapItem
+	if id[0] == 'a' {
+		item = NewAskItem(pt, id, p, q, 0, time.Now().UnixNano())
+		item.SetAccount("seller", STPNone)
+	} else {
+		item = NewBidItem(pt, id, p, q, 0, time.Now().UnixNano())
+		item.SetAccount("buyer", STPNone)
+	}
+	for _, opt := range opts {
+		opt(pair, item)
+	}
+	return pair.NewOrder(item)
+}
+
+func limit(pair *TradePair, id, price, qty string, opts ...orderOption) CommandResult {
+	return place(pair, PriceTypeLimit, id, price, qty, opts...)
+}
+
+func market(pair *TradePair, id, qty string, opts ...orderOption) CommandResult {
+	return place(pair, PriceTypeMarket, id, "0", qty, opts...)
+}
+
+// expect checks the status and filled quantity of orders, given as
+// "status filled".
+func expect(t *testing.T, pair *TradePair, want map[string]string) {
+	t.Helper()
+	for id, w := range want {
+		o, ok := pair.Order(id, "")
+		if !ok {
+			t.Errorf("%s: unknown order", id)
+			continue
+		}
+		if got := o.Status + " " + o.FilledQuantity.String(); got != w {
+			t.Errorf("%s: got %q, want %q (reason %q)", id, got, w, o.Reason)
+		}
+	}
+}
+
+func TestMatching(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules TradingRules
+		run   func(pair *TradePair)
+		want  map[string]string
+		asks  [][2]string
+		bids  [][2]string
+	}{
+		{
+			name: "limit crosses and rests the remainder",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "2")
+				limit(pair, "b-1", "101", "3")
+			},
+			want: map[string]string{"a-1": "filled 2", "b-1": "partially_filled 2"},
+			bids: [][2]string{{"101.00", "1.0000"}},
+		},
+		{
+			name: "best price first, then time",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "101", "1")
+				limit(pair, "a-2", "100", "1")
+				limit(pair, "a-3", "100", "1")
+				limit(pair, "b-1", "101", "2")
+			},
+			want: map[string]string{"a-1": "new 0", "a-2": "filled 1", "a-3": "filled 1", "b-1": "filled 2"},
+			asks: [][2]string{{"101.00", "1.0000"}},
+		},
+		{
+			name: "market order sweeps and cancels what is left",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "a-2", "101", "1")
+				market(pair, "b-1", "3")
+			},
+			want: map[string]string{"a-1": "filled 1", "a-2": "filled 1", "b-1": "cancelled 2"},
+		},
+		{
+			name: "market buy sized by amount",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "a-2", "101", "1")
+				market(pair, "b-1", "0", amount("150"))
+			},
+			want: map[string]string{"a-1": "filled 1", "a-2": "partially_filled 0.495", "b-1": "cancelled 1.495"},
+			asks: [][2]string{{"101.00", "0.5050"}},
+		},
+		{
+			name: "IOC cancels its remainder",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-1", "100", "3", tif(TimeInForceIOC))
+			},
+			want: map[string]string{"a-1": "filled 1", "b-1": "cancelled 1"},
+		},
+		{
+			name: "FOK that cannot fill leaves the book alone",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-1", "100", "3", tif(TimeInForceFOK))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "cancelled 0"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "FOK that can fill trades in full",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "a-2", "101", "2")
+				limit(pair, "b-1", "101", "3", tif(TimeInForceFOK))
+			},
+			want: map[string]string{"a-1": "filled 1", "a-2": "filled 2", "b-1": "filled 3"},
+		},
+		{
+			name: "FOK by amount cancels what it cannot spend",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "a-2", "101", "1")
+				market(pair, "b-1", "0", amount("150"), tif(TimeInForceFOK))
+			},
+			want: map[string]string{"a-1": "filled 1", "a-2": "partially_filled 0.495", "b-1": "cancelled 1.495"},
+			asks: [][2]string{{"101.00", "0.5050"}},
+		},
+		{
+			name: "FOK stops counting at its own order under cancel both",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1", account("buyer", STPNone))
+				limit(pair, "a-2", "100", "1")
+				limit(pair, "b-1", "100", "1", tif(TimeInForceFOK), account("buyer", STPCancelBoth))
+			},
+			want: map[string]string{"a-1": "new 0", "a-2": "new 0", "b-1": "cancelled 0"},
+			asks: [][2]string{{"100.00", "2.0000"}},
+		},
+		{
+			name: "FOK counts past its own order under cancel oldest",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1", account("buyer", STPNone))
+				limit(pair, "a-2", "100", "1")
+				limit(pair, "b-1", "100", "1", tif(TimeInForceFOK), account("buyer", STPCancelOldest))
+			},
+			want: map[string]string{"a-1": "cancelled 0", "a-2": "filled 1", "b-1": "filled 1"},
+		},
+		{
+			name: "GTD already past expires",
+			run: func(pair *TradePair) {
+				limit(pair, "b-1", "100", "1", expireAt(1))
+			},
+			want: map[string]string{"b-1": "expired 0"},
+		},
+		{
+			name: "post-only that would take is rejected",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-1", "100", "1", postOnly(PostOnlyReject))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "rejected 0"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "post-only that would take is slid behind the best ask",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-1", "100", "1", postOnly(PostOnlySlide))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "new 0"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+			bids: [][2]string{{"99.99", "1.0000"}},
+		},
+		{
+			name:  "post-only bid slides to the tick below the best ask",
+			rules: TradingRules{TickSize: dec("0.5")},
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-1", "100.5", "1", postOnly(PostOnlySlide))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "new 0"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+			bids: [][2]string{{"99.50", "1.0000"}},
+		},
+		{
+			name:  "post-only ask slides to the tick above the best bid",
+			rules: TradingRules{TickSize: dec("0.5")},
+			run: func(pair *TradePair) {
+				limit(pair, "b-1", "100", "1")
+				limit(pair, "a-1", "99", "1", postOnly(PostOnlySlide))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "new 0"},
+			asks: [][2]string{{"100.50", "1.0000"}},
+			bids: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "stop buy triggers on the last trade price",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "a-2", "101", "1")
+				place(pair, PriceTypeStop, "b-s", "0", "1", stopAt("100"))
+				limit(pair, "b-1", "100", "1")
+			},
+			want: map[string]string{"a-1": "filled 1", "a-2": "filled 1", "b-s": "filled 1"},
+		},
+		{
+			name: "iceberg shows a slice and replenishes",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "3", display("1"))
+				limit(pair, "b-1", "100", "2")
+			},
+			want: map[string]string{"a-1": "partially_filled 2", "b-1": "filled 2"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "self-trade cancel newest keeps the maker",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1", account("buyer", STPCancelNewest))
+				limit(pair, "b-1", "100", "1", account("buyer", STPCancelNewest))
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "cancelled 0"},
+			asks: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "self-trade cancel oldest lets the taker rest",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1", account("buyer", STPCancelOldest))
+				limit(pair, "b-1", "100", "1", account("buyer", STPCancelOldest))
+			},
+			want: map[string]string{"a-1": "cancelled 0", "b-1": "new 0"},
+			bids: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "amend into the book trades",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "101", "1")
+				limit(pair, "b-1", "100", "1")
+				pair.AmendOrder("b-1", "buyer", dec("101"), decimal.Zero)
+			},
+			want: map[string]string{"a-1": "filled 1", "b-1": "filled 1"},
+		},
+		{
+			name: "amend by another account leaves the order alone",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "101", "1")
+				limit(pair, "b-1", "100", "1")
+				pair.AmendOrder("b-1", "seller", dec("101"), decimal.Zero)
+			},
+			want: map[string]string{"a-1": "new 0", "b-1": "new 0"},
+			asks: [][2]string{{"101.00", "1.0000"}},
+			bids: [][2]string{{"100.00", "1.0000"}},
+		},
+		{
+			name: "cancel removes a resting ask",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "101", "1")
+				pair.CancelOrder("a-1")
+			},
+			want: map[string]string{"a-1": "cancelled 0"},
+		},
+		{
+			name: "cancel finds an ask whatever its id looks like",
+			run: func(pair *TradePair) {
+				limit(pair, "ask-1", "101", "1")
+				pair.CancelOrder("ask-1")
+			},
+			want: map[string]string{"ask-1": "cancelled 0"},
+		},
+		{
+			name: "auction uncrosses at one price",
+			run: func(pair *TradePair) {
+				pair.StartAuction(0)
+				limit(pair, "a-1", "100", "2")
+				limit(pair, "b-1", "102", "1")
+				limit(pair, "b-2", "101", "2")
+				pair.SetStatus(PairStatusOpen)
+			},
+			want: map[string]string{"a-1": "filled 2", "b-1": "filled 1", "b-2": "partially_filled 1"},
+			bids: [][2]string{{"101.00", "1.0000"}},
+		},
+		{
+			name:  "order off the tick is rejected",
+			rules: TradingRules{TickSize: dec("0.5")},
+			run: func(pair *TradePair) {
+				limit(pair, "b-1", "100.25", "1")
+			},
+			want: map[string]string{"b-1": "rejected 0"},
+		},
+		{
+			name:  "price band rejects a taker walking the book",
+			rules: TradingRules{StaticBand: dec("0.05"), BandAction: BandActionReject},
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-0", "100", "1")
+				limit(pair, "a-2", "110", "1")
+				limit(pair, "b-1", "110", "1")
+			},
+			want: map[string]string{"a-2": "new 0", "b-1": "rejected 0"},
+			asks: [][2]string{{"110.00", "1.0000"}},
+		},
+		{
+			name: "order worth more than an int64 is rejected",
+			run: func(pair *TradePair) {
+				limit(pair, "b-1", "1000000000000000", "1000")
+			},
+			want: map[string]string{"b-1": "rejected 0"},
+		},
+		{
+			name: "order beyond the balance is rejected",
+			run: func(pair *TradePair) {
+				limit(pair, "a-1", "100", "5000")
+			},
+			want: map[string]string{"a-1": "rejected 0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := testPair(t, tt.rules)
+			tt.run(pair)
+
+			expect(t, pair, tt.want)
+			if got := pair.GetAskDepth(0); !equalDepth(got, tt.asks) {
+				t.Errorf("asks %v, want %v", got, tt.asks)
+			}
+			if got := pair.GetBidDepth(0); !equalDepth(got, tt.bids) {
+				t.Errorf("bids %v, want %v", got, tt.bids)
+			}
+		})
+	}
+}
+
+func equalDepth(got, want [][2]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSettlement(t *testing.T) {
+	pair := testPair(t, TradingRules{
+		Fees: map[string]FeeRate{FeeTierDefault: {Maker: dec("0.001"), Taker: dec("0.002")}},
+	})
+	limit(pair, "a-1", "100", "2")
+	limit(pair, "b-1", "100", "2")
+
+	tests := []struct {
+		account string
+		want    BalanceRecord
+	}{
+		// the maker seller pays 0.1% of 200 in quote
+		{"seller", BalanceRecord{Base: dec("998"), Quote: dec("1000199.8")}},
+		// the taker buyer pays 0.2% of 2 in base
+		{"buyer", BalanceRecord{Base: dec("1001.996"), Quote: dec("999800")}},
+		{FeeAccountDefault, BalanceRecord{Base: dec("0.004"), Quote: dec("0.2")}},
+	}
+	for _, tt := range tests {
+		got, _ := pair.Balance(tt.account)
+		if !got.Base.Equal(tt.want.Base) || !got.Quote.Equal(tt.want.Quote) || got.BaseHold.Sign() != 0 || got.QuoteHold.Sign() != 0 {
+			t.Errorf("%s: got %+v, want %+v", tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestStopBuyHold(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	limit(pair, "a-1", "100", "1")
+	limit(pair, "a-2", "101", "1")
+
+	// The stop reserves for its price and the 5% margin, not the balance
+	place(pair, PriceTypeStop, "b-s", "0", "1", stopAt("100"))
+	if b, _ := pair.Balance("buyer"); !b.QuoteHold.Equal(dec("105")) {
+		t.Fatalf("stop hold %s, want 105", b.QuoteHold)
+	}
+
+	// Once triggered and filled nothing stays held
+	limit(pair, "b-1", "100", "1")
+	expect(t, pair, map[string]string{"b-s": "filled 1"})
+	b, _ := pair.Balance("buyer")
+	if !b.QuoteHold.IsZero() || !b.Quote.Equal(dec("999799")) {
+		t.Errorf("got %+v, want quote 999799 and nothing held", b)
+	}
+}
+
+func TestCancelStopOrder(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	limit(pair, "a-1", "101", "1")
+	place(pair, PriceTypeStop, "b-s", "0", "1", stopAt("100"))
+
+	// A resting limit order is not a stop and stays on the book
+	if r := pair.CancelStopOrder("a-1"); r.Ok || r.Reason != RejectReasonUnknownOrder {
+		t.Errorf("cancel of a limit order: got %+v, want %s", r, RejectReasonUnknownOrder)
+	}
+	if r := pair.CancelStopOrder("b-s"); !r.Ok {
+		t.Errorf("cancel of a pending stop: got %+v", r)
+	}
+	expect(t, pair, map[string]string{"a-1": "new 0", "b-s": "cancelled 0"})
+}
+
+func TestTransferSupply(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+
+	tests := []struct {
+		asset  string
+		amount int64
+		reason string
+	}{
+		{AssetQuote, math.MaxInt64, RejectReasonMaxSupply},
+		{AssetBase, math.MaxInt64 - pair.QtyLots(dec("2000")), ""},
+		{AssetBase, 1, RejectReasonMaxSupply},
+		{AssetBase, -1, ""},
+	}
+	for _, tt := range tests {
+		if got := pair.Transfer("whale", tt.asset, tt.amount); got.Reason != tt.reason {
+			t.Errorf("%s %d: got %q, want %q", tt.asset, tt.amount, got.Reason, tt.reason)
+		}
+	}
+}
+
+func TestAuctionReference(t *testing.T) {
+	pair := testPair(t, TradingRules{})
+	// The first trade sets the reference, the second the last price
+	limit(pair, "a-1", "100", "1")
+	limit(pair, "b-1", "100", "1")
+	limit(pair, "a-2", "104", "1")
+	limit(pair, "b-2", "104", "1")
+
+	// 101 and 103 execute as much with no imbalance, 101 is nearer 100
+	pair.StartAuction(0)
+	limit(pair, "a-3", "101", "1")
+	limit(pair, "b-3", "103", "1")
+	pair.SetStatus(PairStatusOpen)
+
+	o, _ := pair.Order("b-3", "")
+	if o.Status != OrderStatusFilled || !o.AveragePrice.Equal(dec("101")) {
+		t.Errorf("got %s at %s, want filled at 101", o.Status, o.AveragePrice)
+	}
+}
+
+func TestClientOrderRetention(t *testing.T) {
+	history, retention := *orderHistory, *clientIdRetention
+	defer func() { *orderHistory, *clientIdRetention = history, retention }()
+	*orderHistory = 1
+
+	pair := testPair(t, TradingRules{})
+	limit(pair, "b-1", "100", "1", clientId("c-1"))
+	pair.CancelOrder("b-1")
+	// Push b-1 out of the history
+	limit(pair, "b-2", "100", "1", tif(TimeInForceIOC))
+	limit(pair, "b-3", "100", "1", tif(TimeInForceIOC))
+	if _, ok := pair.Order("b-1", ""); ok {
+		t.Fatal("b-1 is still in the history")
+	}
+
+	if got := limit(pair, "b-4", "100", "1", clientId("c-1")); got.Reason != RejectReasonDuplicateClientId {
+		t.Errorf("reused within the window: got %q, want %q", got.Reason, RejectReasonDuplicateClientId)
+	}
+
+	*clientIdRetention = time.Nanosecond
+	if got := limit(pair, "b-5", "100", "1", clientId("c-1")); !got.Ok {
+		t.Errorf("reused after the window: got %q", got.Reason)
+	}
+}
+
+func TestRejectResult(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules TradingRules
+		run   func(pair *TradePair) CommandResult
+		want  string
+	}{
+		{
+			name: "post-only that would take",
+			run: func(pair *TradePair) CommandResult {
+				limit(pair, "a-1", "100", "1")
+				return limit(pair, "b-1", "100", "1", postOnly(PostOnlyReject))
+			},
+			want: RejectReasonPostOnly,
+		},
+		{
+			name:  "taker outside the price band",
+			rules: TradingRules{StaticBand: dec("0.05"), BandAction: BandActionReject},
+			run: func(pair *TradePair) CommandResult {
+				limit(pair, "a-1", "100", "1")
+				limit(pair, "b-0", "100", "1")
+				limit(pair, "a-2", "110", "1")
+				return limit(pair, "b-1", "110", "1")
+			},
+			want: RejectReasonPriceBand,
+		},
+		{
+			name: "post-only that rests",
+			run: func(pair *TradePair) CommandResult {
+				limit(pair, "a-1", "100", "1")
+				return limit(pair, "b-1", "99", "1", postOnly(PostOnlyReject))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.run(testPair(t, tt.rules))
+			if got.Ok != (tt.want == "") || got.Reason != tt.want {
+				t.Errorf("got ok %v reason %q, want reason %q", got.Ok, got.Reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputOrder(t *testing.T) {
+	*dataDir = t.TempDir()
+	pair, err := NewTradePair("test", 2, 4, TradingRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing reads the outputs until the end, they all fit in the buffer
+	fund(pair, "seller")
+	fund(pair, "buyer")
+	limit(pair, "a-1", "100", "1")
+	limit(pair, "a-2", "101", "1")
+	market(pair, "b-1", "3")
+
+	var records []JournalRecord
+	for len(pair.ChOutput) > 0 {
+		records = append(records, <-pair.ChOutput)
+	}
+	if len(records) == 0 {
+		t.Fatal("no outputs")
+	}
+	for i, rec := range records {
+		// The command result closes the outputs of its command
+		last := i == len(records)-1 || records[i+1].Sequence != rec.Sequence
+		if last != (rec.CommandEvent != nil) {
+			t.Errorf("%d: %s at sequence %d, command result must come last", i, rec.Kind, rec.Sequence)
+		}
+		if i > 0 && rec.Sequence < records[i-1].Sequence {
+			t.Errorf("%d: sequence %d after %d", i, rec.Sequence, records[i-1].Sequence)
+		}
+	}
+
+	// The market buy is accepted, trades twice and loses the rest, each
+	// result after the reports of the orders it changed
+	want := []string{
+		RecordExecution,
+		RecordExecution, RecordExecution, RecordTrade,
+		RecordExecution, RecordExecution, RecordTrade,
+		RecordExecution, RecordCancel,
+		RecordCommandEvent,
+	}
+	var got []string
+	for _, rec := range records {
+		if rec.Sequence == records[len(records)-1].Sequence {
+			got = append(got, rec.Kind)
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("outputs of the last command\n got %v\nwant %v", got, want)
+	}
+}
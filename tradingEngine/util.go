@@ -1,85 +1,239 @@
 package main
 
 import (
-	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+
 	"github.com/shopspring/decimal"
 )
 
-func string2decimal(a string) decimal.Decimal {
-	d, _ := decimal.NewFromString(a)
-	return d
+// string2decimal reads a decimal field. An empty field is zero, anything
+// else that is not a number is an error rather than a silent zero.
+func string2decimal(a string) (decimal.Decimal, error) {
+	if a == "" {
+		return decimal.Zero, nil
+	}
+	return decimal.NewFromString(a)
 }
 
-func FormatDecimal2String(d decimal.Decimal, digit int) string {
-	f, _ := d.Float64()
-	format := "%." + fmt.Sprintf("%d", digit) + "f"
-	return fmt.Sprintf(format, f)
+func string2PriceType(a string) PriceType {
+	switch strings.ToLower(a) {
+	case "market":
+		return PriceTypeMarket
+	case "stop":
+		return PriceTypeStop
+	case "stop_limit":
+		return PriceTypeStopLimit
+	}
+	return PriceTypeLimit
 }
 
-func (t *TradePair) Price2String(price decimal.Decimal) string {
-	return FormatDecimal2String(price, t.priceDigit)
+func OrderSide2String(side OrderSide) string {
+	if side == OrderSideSell {
+		return "sell"
+	}
+	return "buy"
 }
 
-func (t *TradePair) Qty2String(qty decimal.Decimal) string {
-	return FormatDecimal2String(qty, t.quantityDigit)
+func PriceType2String(pt PriceType) string {
+	switch pt {
+	case PriceTypeMarket:
+		return "market"
+	case PriceTypeStop:
+		return "stop"
+	case PriceTypeStopLimit:
+		return "stop_limit"
+	}
+	return "limit"
+}
+
+func CommandType2String(ct CommandType) string {
+	switch ct {
+	case CommandNewOrder:
+		return "new_order"
+	case CommandCancelOrder:
+		return "cancel_order"
+	case CommandExpireOrders:
+		return "expire_orders"
+	case CommandAmendOrder:
+		return "amend_order"
+	case CommandSetAccountSTP:
+		return "set_account_stp"
+	case CommandSetStatus:
+		return "set_status"
+	case CommandEndAuction:
+		return "end_auction"
+	case CommandTransfer:
+		return "transfer"
+	case CommandSetAccountTier:
+		return "set_account_tier"
+	case CommandCancelStopOrder:
+		return "cancel_stop_order"
+	}
+	return "unknown"
 }
 
-func merge(left, right []string, asc_desc string) []string {
-	result := []string{}
+func string2TimeInForce(a string) TimeInForce {
+	switch strings.ToUpper(a) {
+	case "IOC":
+		return TimeInForceIOC
+	case "FOK":
+		return TimeInForceFOK
+	case "GTD":
+		return TimeInForceGTD
+	}
+	return TimeInForceGTC
+}
 
-	for len(left) > 0 || len(right) > 0 {
-		if len(left) > 0 && len(right) > 0 {
-			leftDec, _ := decimal.NewFromString(left[0])
-			rightDec, _ := decimal.NewFromString(right[0])
-			if (asc_desc == "asc" && leftDec.Cmp(rightDec) == -1) || (asc_desc == "desc" && leftDec.Cmp(rightDec) == 1) {
-				result = append(result, left[0])
-				left = left[1:]
-			} else {
-				result = append(result, right[0])
-				right = right[1:]
-			}
-		} else if len(left) > 0 {
-			result = append(result, left[0])
-			left = left[1:]
-		} else if len(right) > 0 {
-			result = append(result, right[0])
-			right = right[1:]
-		}
+func string2PostOnlyMode(a string) PostOnlyMode {
+	if strings.ToLower(a) == "slide" {
+		return PostOnlySlide
 	}
+	return PostOnlyReject
+}
 
-	return result
+func string2STPMode(a string) STPMode {
+	switch strings.ToLower(a) {
+	case "cn", "cancel_newest":
+		return STPCancelNewest
+	case "co", "cancel_oldest":
+		return STPCancelOldest
+	case "cb", "cancel_both":
+		return STPCancelBoth
+	case "dc", "decrement_and_cancel":
+		return STPDecrementCancel
+	}
+	return STPNone
 }
 
-func mergeSort(nums []string, asc_desc string) []string {
-	if len(nums) <= 1 {
-		return nums
+func STPMode2String(mode STPMode) string {
+	switch mode {
+	case STPCancelNewest:
+		return "cancel_newest"
+	case STPCancelOldest:
+		return "cancel_oldest"
+	case STPCancelBoth:
+		return "cancel_both"
+	case STPDecrementCancel:
+		return "decrement_and_cancel"
 	}
+	return "none"
+}
 
-	mid := len(nums) / 2
-	left := nums[:mid]
-	right := nums[mid:]
+// string2PairStatus reports false for a status it does not know.
+func string2PairStatus(a string) (PairStatus, bool) {
+	switch strings.ToLower(a) {
+	case "open":
+		return PairStatusOpen, true
+	case "pre_open":
+		return PairStatusPreOpen, true
+	case "halted":
+		return PairStatusHalted, true
+	case "cancel_only":
+		return PairStatusCancelOnly, true
+	case "delisted":
+		return PairStatusDelisted, true
+	case "auction":
+		return PairStatusAuction, true
+	}
+	return PairStatusOpen, false
+}
 
-	left = mergeSort(left, asc_desc)
-	right = mergeSort(right, asc_desc)
+func PairStatus2String(status PairStatus) string {
+	switch status {
+	case PairStatusPreOpen:
+		return "pre_open"
+	case PairStatusHalted:
+		return "halted"
+	case PairStatusCancelOnly:
+		return "cancel_only"
+	case PairStatusDelisted:
+		return "delisted"
+	case PairStatusAuction:
+		return "auction"
+	}
+	return "open"
+}
 
-	return merge(left, right, asc_desc)
+func FormatDecimal2String(d decimal.Decimal, digit int) string {
+	return d.StringFixed(int32(digit))
 }
 
-func MapToSortedArr(m map[string]string, ask_bid OrderSide) [][2]string {
-	res := [][2]string{}
-	keys := []string{}
-	for k, _ := range m {
-		keys = append(keys, k)
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
 	}
+	return b
+}
+
+// PriceTicks converts a price to whole ticks, dropping anything finer than priceDigit.
+func (t *TradePair) PriceTicks(price decimal.Decimal) int64 {
+	return price.Shift(int32(t.priceDigit)).IntPart()
+}
 
-	if ask_bid == OrderSideSell {
-		keys = mergeSort(keys, "asc")
-	} else {
-		keys = mergeSort(keys, "desc")
+// QtyLots converts a quantity to whole lots, dropping anything finer than quantityDigit.
+func (t *TradePair) QtyLots(qty decimal.Decimal) int64 {
+	return qty.Shift(int32(t.quantityDigit)).IntPart()
+}
+
+// AmountUnits converts a quote amount to ticks x lots, the scale of price * quantity.
+func (t *TradePair) AmountUnits(amount decimal.Decimal) int64 {
+	return amount.Shift(int32(t.priceDigit + t.quantityDigit)).IntPart()
+}
+
+func (t *TradePair) TicksToPrice(ticks int64) decimal.Decimal {
+	return decimal.New(ticks, int32(-t.priceDigit))
+}
+
+func (t *TradePair) LotsToQty(lots int64) decimal.Decimal {
+	return decimal.New(lots, int32(-t.quantityDigit))
+}
+
+func (t *TradePair) UnitsToAmount(units int64) decimal.Decimal {
+	return decimal.New(units, int32(-(t.priceDigit + t.quantityDigit)))
+}
+
+func (t *TradePair) Price2String(price decimal.Decimal) string {
+	return FormatDecimal2String(price, t.priceDigit)
+}
+
+func (t *TradePair) Qty2String(qty decimal.Decimal) string {
+	return FormatDecimal2String(qty, t.quantityDigit)
+}
+
+func (t *TradePair) Amount2String(amount decimal.Decimal) string {
+	return FormatDecimal2String(amount, t.priceDigit+t.quantityDigit)
+}
+
+// mulInt64 multiplies two amounts that are not negative, and reports false
+// when the product does not fit in an int64.
+func mulInt64(a, b int64) (int64, bool) {
+	if a < 0 || b < 0 {
+		return 0, false
+	}
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(lo), true
+}
+
+// notional is price x quantity, capped at the largest int64, which no account
+// can hold.
+func notional(price, quantity int64) int64 {
+	v, ok := mulInt64(price, quantity)
+	if !ok {
+		return math.MaxInt64
 	}
+	return v
+}
 
-	for _, k := range keys {
-		res = append(res, [2]string{k, m[k]})
+// addCapped adds two amounts that are not negative, capped at the largest
+// int64.
+func addCapped(a, b int64) int64 {
+	if a > math.MaxInt64-b {
+		return math.MaxInt64
 	}
-	return res
+	return a + b
 }
@@ -123,15 +123,15 @@ func (c *Client) writePump() {
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func ServeWs(c *gin.Context) {
+// ServeWs handles websocket requests from the peer, subscribing it to hub.
+func ServeWs(hub *Hub, c *gin.Context) {
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
-		hub:         HHub,
+		hub:         hub,
 		conn:        conn,
 		send:        make(chan []byte, 256),
 		lastMsgHash: make(map[string]string),
@@ -1,3 +0,0 @@
-package wss
-
-var HHub *Hub